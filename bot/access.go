@@ -0,0 +1,351 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Role is what a user or chat on the allowlist may do
+type Role string
+
+const (
+	RoleReadOnly Role = "readonly" // status commands only
+	RoleUser     Role = "user"     // download torrents and manage their own jobs
+	RoleAdmin    Role = "admin"    // everything, including managing the allowlist
+)
+
+func parseRole(s string) (Role, bool) {
+	switch role := Role(strings.ToLower(strings.TrimSpace(s))); role {
+	case RoleReadOnly, RoleUser, RoleAdmin:
+		return role, true
+	case "read-only", "ro":
+		return RoleReadOnly, true
+	}
+	return "", false
+}
+
+func (r Role) rank() int {
+	switch r {
+	case RoleReadOnly:
+		return 1
+	case RoleUser:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// allows reports whether r includes everything required may do
+func (r Role) allows(required Role) bool {
+	return r.rank() >= required.rank()
+}
+
+// commandRoles is the least role each command needs, other commands need RoleUser
+var commandRoles = map[string]Role{
+	"start":    RoleReadOnly,
+	"help":     RoleReadOnly,
+	"jobs":     RoleReadOnly,
+	"quota":    RoleReadOnly,
+	"setquota": RoleAdmin,
+	"allow":    RoleAdmin,
+	"deny":     RoleAdmin,
+	"users":    RoleAdmin,
+	"invite":   RoleAdmin,
+	"invites":  RoleAdmin,
+	"revoke":   RoleAdmin,
+}
+
+// requiredRole is the least role needed for a message, sending torrents needs RoleUser
+func requiredRole(message *tgbotapi.Message) Role {
+	if message.IsCommand() {
+		if role, ok := commandRoles[message.Command()]; ok {
+			return role
+		}
+	}
+	return RoleUser
+}
+
+var (
+	errConfiguredUser = errors.New("set in ALLOWED_USERS, change it there")
+	errGroupAdmin     = errors.New("a group chat can be user or readonly, make its members admins one by one")
+)
+
+// Access is the allowlist. Entries are user IDs or, to let a whole group in,
+// chat IDs. A chat entry makes its members users at most, admins are always
+// listed by user ID. Entries from ALLOWED_USERS are fixed, admins add and remove the
+// others at runtime and those are kept in the database. Everyone else is
+// refused, unless ALLOW_EVERYONE lets them in as users
+type Access struct {
+	db       *server.Database
+	logger   *server.Logger
+	everyone bool
+
+	mu         sync.Mutex
+	configured map[int64]Role
+	added      map[int64]server.UserRecord
+}
+
+// NewAccess loads the allowlist
+func NewAccess(configured map[int64]string, everyone bool, db *server.Database, logger *server.Logger) *Access {
+	a := &Access{
+		db:         db,
+		logger:     logger,
+		everyone:   everyone,
+		configured: make(map[int64]Role),
+		added:      make(map[int64]server.UserRecord),
+	}
+
+	for id, name := range configured {
+		role, ok := parseRole(name)
+		if !ok {
+			logger.LogError("Ignoring ALLOWED_USERS entry %d: unknown role %q", id, name)
+			continue
+		}
+		if id < 0 && role == RoleAdmin {
+			logger.LogError("ALLOWED_USERS entry %d is a group chat, its members are users and not admins", id)
+			role = RoleUser
+		}
+		a.configured[id] = role
+	}
+
+	records, err := db.ListUsers()
+	if err != nil {
+		logger.LogError("Failed to load allowed users: %v", err)
+	}
+	for _, record := range records {
+		a.added[record.ID] = record
+	}
+
+	if len(a.Admins()) == 0 {
+		logger.LogError("Warning: no admin on the allowlist, nobody can manage users, invites and quotas. Add one to ALLOWED_USERS such as 12345:admin")
+	}
+	if everyone {
+		logger.LogInfo("ALLOW_EVERYONE is set, users who are not on the allowlist can use the bot")
+	}
+	return a
+}
+
+// Role returns the role of a user writing in a chat. The user's own entry
+// wins over the chat's, which gives no more than RoleUser
+func (a *Access) Role(userID, chatID int64) (Role, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if role, ok := a.lookup(userID); ok {
+		return role, true
+	}
+	if role, ok := a.lookup(chatID); ok {
+		if role.allows(RoleAdmin) {
+			role = RoleUser
+		}
+		return role, true
+	}
+	if a.everyone {
+		return RoleUser, true
+	}
+	return "", false
+}
+
+// lookup finds the entry of id. Caller holds a.mu
+func (a *Access) lookup(id int64) (Role, bool) {
+	if role, ok := a.configured[id]; ok {
+		return role, true
+	}
+	if record, ok := a.added[id]; ok {
+		return Role(record.Role), true
+	}
+	return "", false
+}
+
+// Add puts id on the allowlist with role, or changes its role
+func (a *Access) Add(id int64, role Role, addedBy int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.configured[id]; ok {
+		return errConfiguredUser
+	}
+	if id < 0 && role == RoleAdmin {
+		return errGroupAdmin
+	}
+
+	record := server.UserRecord{ID: id, Role: string(role), AddedBy: addedBy, AddedAt: time.Now()}
+	if err := a.db.SaveUser(record); err != nil {
+		return err
+	}
+	a.added[id] = record
+	return nil
+}
+
+// Remove takes id off the allowlist
+func (a *Access) Remove(id int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.configured[id]; ok {
+		return errConfiguredUser
+	}
+	if _, ok := a.added[id]; !ok {
+		return fmt.Errorf("%d is not on the allowlist", id)
+	}
+
+	if err := a.db.DeleteUser(id); err != nil {
+		return err
+	}
+	delete(a.added, id)
+	return nil
+}
+
+// Admins returns the user IDs with the admin role
+func (a *Access) Admins() []int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var admins []int64
+	for _, id := range sortedIDs(a.configured) {
+		if a.configured[id] == RoleAdmin && id > 0 {
+			admins = append(admins, id)
+		}
+	}
+	for _, id := range sortedIDs(a.added) {
+		if _, ok := a.configured[id]; !ok && Role(a.added[id].Role) == RoleAdmin && id > 0 {
+			admins = append(admins, id)
+		}
+	}
+	return admins
+}
+
+// describe lists the allowlist, configured entries first
+func (a *Access) describe() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var lines []string
+	for _, id := range sortedIDs(a.configured) {
+		lines = append(lines, fmt.Sprintf("%d - %s (ALLOWED_USERS)", id, a.configured[id]))
+	}
+	for _, id := range sortedIDs(a.added) {
+		record := a.added[id]
+		lines = append(lines, fmt.Sprintf("%d - %s (added by %d on %s)",
+			id, record.Role, record.AddedBy, record.AddedAt.Format("2006-01-02")))
+	}
+
+	if a.everyone {
+		lines = append(lines, "everyone else - user (ALLOW_EVERYONE)")
+	}
+	return "Allowed users and chats:\n" + strings.Join(lines, "\n")
+}
+
+func sortedIDs[V any](m map[int64]V) []int64 {
+	ids := make([]int64, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// authorize checks the sender of an update against the allowlist. Rejected
+// updates are logged with the user's ID and answered with the reason
+func (b *Bot) authorize(update tgbotapi.Update) bool {
+	var from *tgbotapi.User
+	var chatID int64
+	var required Role
+
+	switch {
+	case update.CallbackQuery != nil:
+		from = update.CallbackQuery.From
+		if update.CallbackQuery.Message != nil {
+			chatID = update.CallbackQuery.Message.Chat.ID
+		}
+		required = RoleUser
+	case update.Message != nil:
+		from = update.Message.From
+		chatID = update.Message.Chat.ID
+		required = requiredRole(update.Message)
+	default:
+		return false
+	}
+
+	if from == nil {
+		// channel posts have no sender
+		b.Logger.LogError("Rejected update without a sender in chat %d", chatID)
+		return false
+	}
+
+	role, ok := b.Access.Role(from.ID, chatID)
+	if !ok && update.Message != nil && update.Message.Command() == "start" && update.Message.CommandArguments() != "" {
+		// /start <invite code>, answered by redeemInvite when the code is refused
+		return b.redeemInvite(update.Message)
+	}
+
+	var reply string
+	switch {
+	case !ok:
+		b.Logger.LogError("Rejected user %d (@%s) in chat %d: not on the allowlist", from.ID, from.UserName, chatID)
+		reply = fmt.Sprintf("You are not allowed to use this bot. Ask an admin to add your user ID %d.", from.ID)
+	case !role.allows(required):
+		b.Logger.LogError("Rejected user %d (@%s) in chat %d: role %s, %s needed", from.ID, from.UserName, chatID, role, required)
+		reply = fmt.Sprintf("Your role (%s) does not allow this.", role)
+	default:
+		return true
+	}
+
+	if update.CallbackQuery != nil {
+		b.answerCallback(update.CallbackQuery, reply)
+	} else {
+		b.Sender.Send(tgbotapi.NewMessage(chatID, reply))
+	}
+	return false
+}
+
+// allowUser handles /allow <id> [role]
+func (b *Bot) allowUser(message *tgbotapi.Message) string {
+	fields := strings.Fields(message.CommandArguments())
+	if len(fields) == 0 || len(fields) > 2 {
+		return "Usage: /allow <user or chat id> [admin|user|readonly]"
+	}
+	id, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "Usage: /allow <user or chat id> [admin|user|readonly]"
+	}
+	role := RoleUser
+	if len(fields) == 2 {
+		var ok bool
+		if role, ok = parseRole(fields[1]); !ok {
+			return fmt.Sprintf("Unknown role %q, use admin, user or readonly.", fields[1])
+		}
+	}
+
+	if err := b.Access.Add(id, role, message.From.ID); err != nil {
+		return fmt.Sprintf("Could not allow %d: %v", id, err)
+	}
+	b.Logger.LogInfo("User %d allowed %d as %s", message.From.ID, id, role)
+	return fmt.Sprintf("%d can now use the bot as %s.", id, role)
+}
+
+// denyUser handles /deny <id>
+func (b *Bot) denyUser(message *tgbotapi.Message) string {
+	id, err := strconv.ParseInt(strings.TrimSpace(message.CommandArguments()), 10, 64)
+	if err != nil {
+		return "Usage: /deny <user or chat id>"
+	}
+	if id == message.From.ID {
+		return "You cannot remove yourself."
+	}
+
+	if err := b.Access.Remove(id); err != nil {
+		return fmt.Sprintf("Could not remove %d: %v", id, err)
+	}
+	b.Logger.LogInfo("User %d removed %d from the allowlist", message.From.ID, id)
+	return fmt.Sprintf("%d can no longer use the bot.", id)
+}
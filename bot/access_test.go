@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessChatEntries(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := server.NewLogger(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	db, err := server.OpenDatabase(filepath.Join(dir, ".bot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// no admin at all still gives a working allowlist
+	a := NewAccess(map[int64]string{-100: "admin", 7: "readonly"}, false, db, logger)
+	if admins := a.Admins(); len(admins) != 0 {
+		t.Errorf("admins = %v, want none", admins)
+	}
+
+	tests := []struct {
+		userID, chatID int64
+		role           Role
+		ok             bool
+	}{
+		{1, -100, RoleUser, true},     // a group entry makes its members users, not admins
+		{7, -100, RoleReadOnly, true}, // the user's own entry wins
+		{1, 1, "", false},
+	}
+	for _, tt := range tests {
+		role, ok := a.Role(tt.userID, tt.chatID)
+		if role != tt.role || ok != tt.ok {
+			t.Errorf("Role(%d, %d) = %s, %v, want %s, %v", tt.userID, tt.chatID, role, ok, tt.role, tt.ok)
+		}
+	}
+
+	if err := a.Add(-200, RoleAdmin, 1); !errors.Is(err, errGroupAdmin) {
+		t.Errorf("adding a group as admin = %v, want %v", err, errGroupAdmin)
+	}
+	if err := a.Add(2, RoleAdmin, 1); err != nil {
+		t.Fatal(err)
+	}
+	if role, _ := a.Role(2, -100); role != RoleAdmin {
+		t.Errorf("admin in the group is %s", role)
+	}
+}
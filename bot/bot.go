@@ -2,20 +2,51 @@ package bot
 
 import (
 	"BotTelegram/server"
+	"fmt"
+	"strings"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 type Bot struct {
-	Config *BotConfig
-	Logger *server.Logger
+	Config  *BotConfig
+	Logger  *server.Logger
+	Engine  *server.Engine
+	DB      *server.Database
+	Prober  server.Prober
+	Links   *server.FileLinks // nil without PUBLIC_URL
+	Sender  *Sender
+	Jobs    *JobQueue
+	Access  *Access
+	Janitor *Janitor
+
+	stop    chan struct{}
+	fetched chan fetchResult // metadata fetched in the background, handled by the update loop
 }
 
-func NewBot(cfg *BotConfig, logger *server.Logger) *Bot {
-	return &Bot{
-		Config: cfg,
-		Logger: logger,
+func NewBot(cfg *BotConfig, engine *server.Engine, db *server.Database, prober server.Prober, links *server.FileLinks, logger *server.Logger) *Bot {
+	b := &Bot{
+		Config:  cfg,
+		Logger:  logger,
+		Engine:  engine,
+		DB:      db,
+		Prober:  prober,
+		Links:   links,
+		stop:    make(chan struct{}),
+		fetched: make(chan fetchResult),
 	}
+	b.Sender = NewSender(cfg.API, cfg.AppConfig.TelegramRateLimit, logger, b.stop)
+	b.Access = NewAccess(cfg.AppConfig.AllowedUsers, cfg.AppConfig.AllowEveryone, db, logger)
+	b.Janitor = NewJanitor(b)
+	b.Jobs = NewJobQueue(
+		cfg.AppConfig.MaxConcurrentDownloads,
+		cfg.AppConfig.MaxUserDownloads,
+		db.NextJobID,
+		b.runJob,
+		b.persistJob,
+	)
+	return b
 }
 
 // Start and listen
@@ -28,15 +59,103 @@ func (b *Bot) Start() error {
 
 	b.Logger.LogInfo("Bot started successfully. Waiting for messages...")
 
-	for update := range updates {
-		
+	go b.watchDiskSpace()
+	go b.Janitor.Run(b.stop)
+
+	for {
+		var update tgbotapi.Update
+		select {
+		case <-b.stop:
+			// updates still in flight are dropped, Telegram redelivers them after restart
+			return nil
+		case u, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			update = u
+		case result := <-b.fetched:
+			b.handleFetched(result)
+			continue
+		}
+
+		if !b.authorize(update) {
+			continue
+		}
+
+		if update.CallbackQuery != nil {
+			b.handleCallback(update.CallbackQuery)
+			continue
+		}
+
 		if update.Message == nil {
 			continue
 		}
 
-		b.Logger.LogInfo("[%s] %s", update.Message.From.UserName, update.Message.Text)
+		b.Logger.LogInfo("[%s] %s", update.Message.From.UserName, loggedText(update.Message))
 		b.handleMessage(update.Message)
 	}
+}
+
+// stopping reports whether Shutdown has been called
+func (b *Bot) stopping() bool {
+	select {
+	case <-b.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops taking updates, stops the downloads and waits up to timeout
+// for uploads in progress. Stored jobs are resumed by ResumeJobs on the next start.
+// Reports whether every job goroutine returned, the database must stay open otherwise
+func (b *Bot) Shutdown(timeout time.Duration) bool {
+	close(b.stop)
+	b.Config.API.StopReceivingUpdates()
+
+	// No new jobs start from here on
+	jobs := b.Jobs.Stop()
+
+	// Downloads stop right away, their data and records stay for the restart
+	for _, job := range jobs {
+		if job.Status() == JobDownloading {
+			job.Downloader.Close()
+		}
+	}
+
+	stopped := b.Jobs.Wait(timeout)
+	if !stopped {
+		b.Logger.LogError("Timed out after %s waiting for uploads to finish", timeout)
+	}
+	b.Janitor.SaveSeeding()
 
-	return nil
+	b.notifyShutdown(jobs)
+	// the limiter served the uploads and notices above, nothing is sent after this
+	b.Sender.Close()
+	return stopped
+}
+
+// notifyShutdown tells every user with unfinished jobs what happens to them
+func (b *Bot) notifyShutdown(jobs []*Job) {
+	lines := make(map[int64][]string)
+	for _, job := range jobs {
+		status := job.Status()
+		switch {
+		case status.Finished():
+			continue
+		case status >= JobQueued:
+			lines[job.ChatID] = append(lines[job.ChatID],
+				fmt.Sprintf("#%d %s - will resume after restart", job.ID, job.Name()))
+		default:
+			lines[job.ChatID] = append(lines[job.ChatID],
+				fmt.Sprintf("#%d %s - please send the link again after restart", job.ID, job.Name()))
+		}
+	}
+
+	for chatID, chatLines := range lines {
+		msg := tgbotapi.NewMessage(chatID, "The bot is restarting.\n"+strings.Join(chatLines, "\n"))
+		if _, err := b.Sender.Send(msg); err != nil {
+			b.Logger.LogError("Failed to notify chat %d about shutdown: %v", chatID, err)
+		}
+	}
 }
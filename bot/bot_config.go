@@ -16,7 +16,13 @@ type BotConfig struct {
 }
 
 func NewBotConfig(cfg *config.Config, logger *server.Logger) (*BotConfig, error) {
-	bot, err := tgbotapi.NewBotAPI(cfg.TelegramToken)
+	apiEndpoint := tgbotapi.APIEndpoint
+	if cfg.TelegramAPIURL != "" {
+		apiEndpoint = cfg.TelegramAPIURL + "/bot%s/%s"
+		logger.LogInfo("Using Bot API server %s (upload limit %s)", cfg.TelegramAPIURL, server.FormatBytes(cfg.MaxFileSize))
+	}
+
+	bot, err := tgbotapi.NewBotAPIWithAPIEndpoint(cfg.TelegramToken, apiEndpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// diskCheckInterval is how often the free space is checked
+	diskCheckInterval = 30 * time.Second
+	// diskResumeMargin is the space above the reserve needed to resume, so
+	// downloads do not flip between paused and running
+	diskResumeMargin = 256 << 20
+)
+
+// checkDiskSpace refuses a selection of size bytes that does not fit on the
+// download disk next to the reserve and what other jobs still have to download
+func (b *Bot) checkDiskSpace(job *Job, size int64) error {
+	free, err := server.FreeSpace(b.Config.AppConfig.DownloadPath)
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			b.Logger.LogError("Failed to check free disk space: %v", err)
+		}
+		return nil
+	}
+
+	var pending int64
+	for _, other := range b.Jobs.ActiveJobs() {
+		if other != job && other.Status() >= JobQueued && other.Status() <= JobDownloading {
+			pending += other.bytesToDownload()
+		}
+	}
+
+	available := free - b.Config.AppConfig.DiskReserve - pending
+	if available < 0 {
+		available = 0
+	}
+	if size > available {
+		return fmt.Errorf("not enough disk space: %s selected, %s available", server.FormatBytes(size), server.FormatBytes(available))
+	}
+	return nil
+}
+
+// bytesToDownload is how much of the selection is not on disk yet
+func (j *Job) bytesToDownload() int64 {
+	if j.Downloader == nil {
+		return 0
+	}
+	remaining := sumSizes(j.Files, j.Downloader.SelectedFiles()) - j.Downloader.BytesCompleted()
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// watchDiskSpace pauses all downloads while the free space is below the
+// reserve and resumes them once there is room again
+func (b *Bot) watchDiskSpace() {
+	if _, err := server.FreeSpace(b.Config.AppConfig.DownloadPath); errors.Is(err, errors.ErrUnsupported) {
+		b.Logger.LogInfo("Free disk space cannot be checked on this platform, downloads are not paused when the disk fills up")
+		return
+	}
+
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+
+		free, err := server.FreeSpace(b.Config.AppConfig.DownloadPath)
+		if err != nil {
+			b.Logger.LogError("Failed to check free disk space: %v", err)
+			continue
+		}
+
+		reserve := b.Config.AppConfig.DiskReserve
+		switch {
+		case !b.Engine.Paused() && free < reserve:
+			b.Engine.PauseDownloads()
+			b.Logger.LogError("Paused all downloads, %s free is below the reserve of %s", server.FormatBytes(free), server.FormatBytes(reserve))
+			b.notifyDownloading(fmt.Sprintf("Downloads are paused: the server has only %s of disk space left. They continue by themselves once space is freed.", server.FormatBytes(free)))
+
+		case b.Engine.Paused() && free >= reserve+diskResumeMargin:
+			b.Engine.ResumeDownloads()
+			b.Logger.LogInfo("Resumed downloads, %s free", server.FormatBytes(free))
+			b.notifyDownloading("Disk space is available again, downloads continue.")
+		}
+	}
+}
+
+// notifyDownloading sends text to every chat with a job downloading or waiting to
+func (b *Bot) notifyDownloading(text string) {
+	jobs := make(map[int64][]string)
+	for _, job := range b.Jobs.ActiveJobs() {
+		if status := job.Status(); status == JobQueued || status == JobDownloading {
+			jobs[job.ChatID] = append(jobs[job.ChatID], fmt.Sprintf("#%d %s", job.ID, job.Name()))
+		}
+	}
+
+	for _, chatID := range sortedIDs(jobs) {
+		msg := tgbotapi.NewMessage(chatID, text+"\n"+strings.Join(jobs[chatID], "\n"))
+		if _, err := b.Sender.Send(msg); err != nil {
+			b.Logger.LogError("Failed to notify chat %d about disk space: %v", chatID, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"fmt"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fileKey is the cache key of a file of the job's torrent
+func fileKey(job *Job, file server.TorrentFile) string {
+	return server.FileCacheKey(job.Downloader.InfoHash(), file.Name)
+}
+
+// partKey is the cache key of one part of a split file, parts differ with the part size
+func partKey(key string, index, count int, partSize int64) string {
+	return fmt.Sprintf("%s#part%d/%d@%d", key, index, count, partSize)
+}
+
+// sentFileID returns the file_id Telegram gave a sent file and the kind it
+// ended up as, a video Telegram cannot play comes back as a document
+func sentFileID(msg tgbotapi.Message) (string, mediaKind) {
+	switch {
+	case msg.Video != nil:
+		return msg.Video.FileID, mediaVideo
+	case msg.Audio != nil:
+		return msg.Audio.FileID, mediaAudio
+	case len(msg.Photo) > 0:
+		// sizes are ordered from small to large
+		return msg.Photo[len(msg.Photo)-1].FileID, mediaPhoto
+	case msg.Document != nil:
+		return msg.Document.FileID, mediaDocument
+	}
+	return "", mediaDocument
+}
+
+// cacheUpload remembers the file_id of a file just sent under key
+func (b *Bot) cacheUpload(key string, msg tgbotapi.Message, size int64, contentHash string) {
+	fileID, kind := sentFileID(msg)
+	if fileID == "" {
+		return
+	}
+
+	cached := server.CachedFile{FileID: fileID, Kind: kind.String(), Size: size, ContentHash: contentHash}
+	if err := b.DB.CacheFile(key, cached); err != nil {
+		b.Logger.LogError("Failed to cache file_id of %s: %v", key, err)
+	}
+}
+
+// contentHash returns the SHA-256 of a file to upload. The file is read once,
+// the hash stays with the job and goes into its download record, where uploads
+// of the same file by later jobs find it
+func (b *Bot) contentHash(job *Job, path string) (string, error) {
+	job.mu.Lock()
+	hash, ok := job.hashes[path]
+	job.mu.Unlock()
+	if ok {
+		return hash, nil
+	}
+
+	if rel, found := b.Janitor.relPath(path); found {
+		var err error
+		hash, found, err = b.DB.DownloadHash(rel)
+		if err != nil {
+			b.Logger.LogError("Failed to look up the hash of %s: %v", rel, err)
+		}
+		ok = found
+	}
+	if !ok {
+		var err error
+		if hash, err = server.HashFile(path); err != nil {
+			return "", err
+		}
+	}
+
+	job.mu.Lock()
+	if job.hashes == nil {
+		job.hashes = make(map[string]string)
+	}
+	job.hashes[path] = hash
+	job.mu.Unlock()
+	return hash, nil
+}
+
+// cachedFile looks up key, or the content hash when it is set
+func (b *Bot) cachedFile(key, contentHash string) (server.CachedFile, bool) {
+	var cached server.CachedFile
+	var found bool
+	var err error
+	if contentHash != "" {
+		cached, found, err = b.DB.CachedContent(contentHash)
+	} else {
+		cached, found, err = b.DB.CachedFile(key)
+	}
+	if err != nil {
+		b.Logger.LogError("Failed to look up cached file %s: %v", key, err)
+		return cached, false
+	}
+	return cached, found
+}
+
+// sendCached re-sends a file Telegram already has by its file_id, looked up by
+// key or, when contentHash is set, by content. It reports whether the file was
+// sent. file_ids Telegram rejects are forgotten so the file is uploaded again
+func (b *Bot) sendCached(chatID int64, key, contentHash string, file server.TorrentFile, caption string) bool {
+	cached, found := b.cachedFile(key, contentHash)
+	if !found {
+		return false
+	}
+
+	_, err := b.sendMedia(chatID, parseMediaKind(cached.Kind), file, tgbotapi.FileID(cached.FileID), caption)
+	if err != nil {
+		b.Logger.LogError("Cached file_id of %s was rejected, uploading again: %v", file.Name, err)
+		if err := b.DB.ForgetFile(key, cached); err != nil {
+			b.Logger.LogError("Failed to forget cached file %s: %v", key, err)
+		}
+		return false
+	}
+
+	if contentHash != "" {
+		// the same bytes came from another torrent, remember them for this one too
+		if err := b.DB.CacheFile(key, cached); err != nil {
+			b.Logger.LogError("Failed to cache file_id of %s: %v", key, err)
+		}
+	}
+	b.Logger.LogInfo("Sent %s from the file_id cache", file.Name)
+	return true
+}
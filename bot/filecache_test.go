@@ -0,0 +1,50 @@
+package bot
+
+import (
+	"BotTelegram/config"
+	"BotTelegram/server"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestContentHashReadsOnce(t *testing.T) {
+	b := newJanitorBot(t, config.Config{RetentionPolicy: retainForever})
+	writeFiles(t, b, time.Hour, 10, "hash/Show/E01.mkv")
+	path := filepath.Join(b.Config.AppConfig.DownloadPath, "hash", "Show", "E01.mkv")
+	want, err := server.HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := b.Jobs.NewJob(1, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := b.contentHash(first, path); err != nil || hash != want {
+		t.Fatalf("contentHash = %s, %v, want %s", hash, err, want)
+	}
+
+	// a file that is read again would give another hash
+	if err := os.WriteFile(path, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := b.contentHash(first, path); hash != want {
+		t.Errorf("second hash of the job = %s, want %s kept from the first", hash, want)
+	}
+
+	// a later job finds the hash in the download record
+	hashes := b.Janitor.jobHashes(first)
+	if hashes["hash/Show/E01.mkv"] != want {
+		t.Fatalf("record hashes = %v, want %s for hash/Show/E01.mkv", hashes, want)
+	}
+	saveDownload(t, b, server.DownloadRecord{Paths: []string{"hash/Show/E01.mkv"}, Hashes: hashes}, time.Hour)
+	second, err := b.Jobs.NewJob(1, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := b.contentHash(second, path); hash != want {
+		t.Errorf("hash of the next job = %s, want %s from the record", hash, want)
+	}
+}
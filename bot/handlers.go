@@ -2,8 +2,10 @@ package bot
 
 import (
 	"BotTelegram/server"
+	"bytes"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -21,18 +23,18 @@ const (
 	StateNone UserState = iota
 	StateAwaitingMagnet
 	StateSelectingFiles
-	StateDownloading
 )
 
 // UserSession represents a user's session
+// Downloads live in the job queue, the session only tracks the job being set up
 type UserSession struct {
-	State       UserState
-	Downloader  *server.Downloader
-	MagnetLink  string
-	Files       []server.TorrentFile
-	ProgressMsg *tgbotapi.Message
+	State   UserState
+	Pending *Job
 }
 
+// Upper bound for uploaded .torrent files, real ones are a few hundred KB
+const maxTorrentFileSize = 10 * 1024 * 1024
+
 // Global sessions map
 var (
 	sessions = make(map[int64]*UserSession)
@@ -48,10 +50,6 @@ func (b *Bot) getSession(chatID int64) *UserSession {
 	if !exists {
 		session = &UserSession{
 			State: StateNone,
-			Downloader: server.NewDownloader(
-				b.Config.AppConfig.DownloadPath,
-				b.Logger,
-			),
 		}
 		sessions[chatID] = session
 	}
@@ -69,6 +67,12 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 		return
 	}
 
+	// .torrent uploads go through the same flow as magnet links
+	if isTorrentDocument(message.Document) {
+		b.handleTorrentFile(message, session)
+		return
+	}
+
 	// Handle message based on state
 	switch session.State {
 	case StateAwaitingMagnet:
@@ -76,8 +80,8 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 			b.handleMagnetLink(message, session)
 		} else {
 			msg := tgbotapi.NewMessage(message.Chat.ID,
-				"That doesn't look like a magnet link. Please send a valid magnet link starting with 'magnet:'.")
-			b.Config.API.Send(msg)
+				"That doesn't look like a magnet link. Please send a valid magnet link starting with 'magnet:' or a .torrent file.")
+			b.Sender.Send(msg)
 		}
 
 	case StateSelectingFiles:
@@ -90,8 +94,8 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 		} else {
 			// Default response for unrecognized messages
 			msg := tgbotapi.NewMessage(message.Chat.ID,
-				"Send me a magnet link to download a torrent or use /help to see available commands.")
-			b.Config.API.Send(msg)
+				"Send me a magnet link or a .torrent file to download a torrent or use /help to see available commands.")
+			b.Sender.Send(msg)
 		}
 	}
 }
@@ -102,301 +106,477 @@ func (b *Bot) handleCommand(message *tgbotapi.Message, session *UserSession) {
 
 	switch message.Command() {
 	case "start":
-		reply = "Welcome to Torrent Downloader Bot!\nSend me a magnet link, and I'll download it for you."
+		reply = "Welcome to Torrent Downloader Bot!\nSend me a magnet link or a .torrent file, and I'll download it for you."
 		session.State = StateAwaitingMagnet
 
 	case "help":
 		reply = "Available commands:\n" +
 			"/start - Start the bot\n" +
 			"/help - Show this help message\n" +
-			"/cancel - Cancel current operation\n" +
-			"\nOr simply send a magnet link to download a torrent."
+			"/jobs - List your torrent jobs\n" +
+			"/cancel - Cancel the file selection in progress\n" +
+			"/cancel <id> - Cancel a job\n" +
+			"/stream <id> [file] - Watch a file while it downloads\n" +
+			"/quota - Show your limits and what you have used\n" +
+			"\nOr simply send a magnet link or a .torrent file to download a torrent."
+		if role, _ := b.Access.Role(message.From.ID, message.Chat.ID); role == RoleAdmin {
+			reply += "\n\nAdmin commands:\n" +
+				"/users - List allowed users and chats\n" +
+				"/allow <id> [admin|user|readonly] - Allow a user or chat, or change its role\n" +
+				"/deny <id> - Remove a user or chat\n" +
+				"/invite [uses] [hours] [role] - Create an invite code\n" +
+				"/invites - List active invite codes\n" +
+				"/revoke <code> - Revoke an invite code\n" +
+				"/quota <id> - Show the quota of a user\n" +
+				"/setquota <id> <storage|daily|monthly|jobs> <value> - Change a user's quota"
+		}
+
+	case "jobs":
+		reply = b.formatJobs(message.Chat.ID)
 
 	case "cancel":
-		if session.Downloader != nil {
-			session.Downloader.Close()
-		}
-		session.State = StateNone
-		session.MagnetLink = ""
-		session.Files = nil
-		reply = "Current operation cancelled. You can send a new magnet link to start again."
+		reply = b.cancelJob(message, session)
+
+	case "stream":
+		reply = b.streamJob(message.Chat.ID, message.CommandArguments())
+
+	case "users":
+		reply = b.Access.describe()
+
+	case "allow":
+		reply = b.allowUser(message)
+
+	case "deny":
+		reply = b.denyUser(message)
+
+	case "quota":
+		reply = b.showQuota(message)
+
+	case "setquota":
+		reply = b.setQuota(message)
+
+	case "invite":
+		reply = b.createInvite(message)
+
+	case "invites":
+		reply = b.listInvites()
+
+	case "revoke":
+		reply = b.revokeInvite(message)
 
 	default:
 		reply = "Unknown command. Use /help to see available commands."
 	}
 
 	msg := tgbotapi.NewMessage(message.Chat.ID, reply)
-	b.Config.API.Send(msg)
+	b.Sender.Send(msg)
+}
+
+// cancelJob cancels the job given as argument, or the pending selection without one
+func (b *Bot) cancelJob(message *tgbotapi.Message, session *UserSession) string {
+	chatID := message.Chat.ID
+	arg := strings.TrimPrefix(strings.TrimSpace(message.CommandArguments()), "#")
+
+	if arg == "" {
+		if session.Pending == nil {
+			session.State = StateNone
+			return "Nothing to cancel. Use /jobs to see your jobs and /cancel <id> to cancel one."
+		}
+		b.Jobs.Cancel(chatID, session.Pending.ID)
+		session.Pending = nil
+		session.State = StateNone
+		return "Current operation cancelled. You can send a new magnet link to start again."
+	}
+
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return "Usage: /cancel <job id>"
+	}
+
+	job, err := b.Jobs.Cancel(chatID, id)
+	if err != nil {
+		return fmt.Sprintf("Could not cancel: %v", err)
+	}
+	if session.Pending == job {
+		session.Pending = nil
+		session.State = StateNone
+	}
+	return fmt.Sprintf("%s cancelled.", job.Label())
+}
+
+// formatJobs lists the unfinished jobs of a chat
+func (b *Bot) formatJobs(chatID int64) string {
+	var sb strings.Builder
+	for _, job := range b.Jobs.UserJobs(chatID) {
+		if job.Status().Finished() {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("#%d %s - %s\n", job.ID, job.Name(), job.Status()))
+	}
+
+	if sb.Len() == 0 {
+		return "You have no active jobs."
+	}
+	return "Your jobs:\n" + sb.String()
 }
 
 // handleMagnetLink processes magnet links and starts fetching metadata
 func (b *Bot) handleMagnetLink(message *tgbotapi.Message, session *UserSession) {
 	magnetLink := message.Text
+
+	b.fetchTorrentInfo(message.Chat.ID, message.From.ID, session, magnetLink, func(d *server.Downloader) ([]server.TorrentFile, error) {
+		return d.GetTorrentInfo(magnetLink)
+	})
+}
+
+// handleTorrentFile downloads an uploaded .torrent file from Telegram and starts fetching metadata
+func (b *Bot) handleTorrentFile(message *tgbotapi.Message, session *UserSession) {
 	chatID := message.Chat.ID
+	doc := message.Document
+
+	if doc.FileSize > maxTorrentFileSize {
+		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Torrent file is too large (%s).", server.FormatBytes(int64(doc.FileSize))))
+		b.Sender.Send(msg)
+		return
+	}
 
-	// Reset session
-	if session.Downloader != nil {
-		session.Downloader.Close()
+	b.fetchTorrentInfo(chatID, message.From.ID, session, "", func(d *server.Downloader) ([]server.TorrentFile, error) {
+		data, err := b.downloadTelegramFile(doc.FileID)
+		if err != nil {
+			b.Logger.LogError("Failed to download torrent file %s: %v", doc.FileName, err)
+			return nil, err
+		}
+		return d.GetTorrentInfoFromFile(bytes.NewReader(data))
+	})
+}
+
+// fetchTorrentInfo creates a job, runs fetch in the background and shows the file list
+func (b *Bot) fetchTorrentInfo(chatID, userID int64, session *UserSession, magnetLink string, fetch func(*server.Downloader) ([]server.TorrentFile, error)) {
+	if err := b.checkJobQuota(userID, session.Pending); err != nil {
+		b.Sender.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Cannot start a new job: %v.", err)))
+		return
 	}
-	session.MagnetLink = magnetLink
-	session.Files = nil
+
+	// A new link replaces a selection in progress, queued and running jobs are left alone
+	if session.Pending != nil {
+		b.Jobs.Cancel(chatID, session.Pending.ID)
+	}
+
+	job, err := b.Jobs.NewJob(chatID, userID, server.NewDownloader(b.Engine, b.Logger))
+	if err != nil {
+		b.Logger.LogError("Failed to create a job for chat %d: %v", chatID, err)
+		b.Sender.Send(tgbotapi.NewMessage(chatID, "Could not start a new job, please try again later."))
+		return
+	}
+	job.MagnetLink = magnetLink
+	session.Pending = job
 	session.State = StateAwaitingMagnet
 
 	// Send initial response
-	msg := tgbotapi.NewMessage(chatID, "Fetching torrent metadata... This might take a moment.")
-	sentMsg, err := b.Config.API.Send(msg)
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("%s: fetching torrent metadata... This might take a moment.", job.Label()))
+	sentMsg, err := b.Sender.Send(msg)
 	if err != nil {
 		b.Logger.LogError("Error sending message: %v", err)
 		return
 	}
 
-	// Fetch torrent info
+	// Fetch torrent info, the result goes back to the update loop
 	go func() {
-		files, err := session.Downloader.GetTorrentInfo(magnetLink)
-		if err != nil {
-			updateMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID,
-				fmt.Sprintf("Error fetching torrent information: %v", err))
-			b.Config.API.Send(updateMsg)
-			return
+		files, err := fetch(job.Downloader)
+		select {
+		case b.fetched <- fetchResult{job: job, session: session, msgID: sentMsg.MessageID, files: files, err: err}:
+		case <-b.stop:
 		}
+	}()
+}
 
-		// Store files in session
-		session.Files = files
-		session.State = StateSelectingFiles
-
-		// Build file list message
-		var sb strings.Builder
-		sb.WriteString("Select files to download by sending their numbers separated by commas (e.g., '1,3,5'):\n\n")
+// fetchResult is the outcome of fetching the metadata of a job. It is handled
+// by the update loop, so sessions and the picker are only touched there
+type fetchResult struct {
+	job     *Job
+	session *UserSession
+	msgID   int
+	files   []server.TorrentFile
+	err     error
+}
 
-		for i, file := range files {
-			//remove server.formatbytes since server.TorrentFile no longer has the Size field.
-			sb.WriteString(fmt.Sprintf("%d. %s\n", i+1, file.Name))
+// handleFetched shows the file picker once metadata arrived
+func (b *Bot) handleFetched(result fetchResult) {
+	job, session := result.job, result.session
+	chatID := job.ChatID
+	if job.Status() == JobCancelled {
+		return
+	}
+	if result.err != nil {
+		b.Jobs.Fail(job)
+		job.Downloader.Close()
+		if session.Pending == job {
+			session.Pending = nil
+			session.State = StateNone
 		}
+		updateMsg := tgbotapi.NewEditMessageText(chatID, result.msgID,
+			fmt.Sprintf("%s: error fetching torrent information: %v", job.Label(), result.err))
+		b.Sender.Send(updateMsg)
+		return
+	}
 
-		sb.WriteString("\nOr send 'all' to download all files.")
-
-		// Send file selection message
-		updateMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, sb.String())
-		b.Config.API.Send(updateMsg)
-	}()
+	// Store files in job
+	job.Files = result.files
+	job.PickerMsgID = result.msgID
+	job.uploadLimit = b.Config.AppConfig.MaxFileSize
+	job.canLink = b.Links != nil
+	initPicker(job)
+	job.setName(job.Downloader.Name())
+	job.setStatus(JobSelecting)
+	session.State = StateSelectingFiles
+
+	// Turn the status message into the file picker
+	updateMsg := tgbotapi.NewEditMessageTextAndMarkup(chatID, result.msgID, pickerText(job), pickerKeyboard(job))
+	b.Sender.Send(updateMsg)
 }
 
-// handleFileSelection processes file selection from user
-func (b *Bot) handleFileSelection(message *tgbotapi.Message, session *UserSession) {
-	chatID := message.Chat.ID
-	selection := strings.TrimSpace(message.Text)
-
-	// Check if user wants all files
-	if strings.ToLower(selection) == "all" {
-		// Select all files
-		var fileIDs []int
-		for i := range session.Files {
-			fileIDs = append(fileIDs, i)
-		}
+// downloadTelegramFile fetches the content of a file sent to the bot
+func (b *Bot) downloadTelegramFile(fileID string) ([]byte, error) {
+	file, err := b.Config.API.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return nil, err
+	}
 
-		err := session.Downloader.SelectFiles(fileIDs)
+	// A server running with --local returns the absolute path of the file on its disk
+	appCfg := b.Config.AppConfig
+	if appCfg.TelegramLocalFiles && filepath.IsAbs(file.FilePath) {
+		f, err := os.Open(file.FilePath)
 		if err != nil {
-			msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Error selecting files: %v", err))
-			b.Config.API.Send(msg)
-			return
+			return nil, err
 		}
+		defer f.Close()
+		return io.ReadAll(io.LimitReader(f, maxTorrentFileSize))
+	}
 
-		b.startDownload(message, session)
-		return
+	url := file.Link(b.Config.Token)
+	if appCfg.TelegramAPIURL != "" {
+		url = fmt.Sprintf("%s/file/bot%s/%s", appCfg.TelegramAPIURL, b.Config.Token, file.FilePath)
 	}
 
-	// Parse file numbers
-	parts := strings.Split(selection, ",")
-	var fileIDs []int
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-	for _, part := range parts {
-		num, err := strconv.Atoi(strings.TrimSpace(part))
-		if err != nil {
-			msg := tgbotapi.NewMessage(chatID, "Invalid selection format. Please use numbers separated by commas (e.g., '1,3,5').")
-			b.Config.API.Send(msg)
-			return
-		}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status downloading file: %s", resp.Status)
+	}
 
-		// Adjust for 0-based indexing
-		fileID := num - 1
+	return io.ReadAll(io.LimitReader(resp.Body, maxTorrentFileSize))
+}
 
-		// Validate file ID
-		if fileID < 0 || fileID >= len(session.Files) {
-			msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Invalid file number: %d. Please select numbers between 1 and %d.",
-				num, len(session.Files)))
-			b.Config.API.Send(msg)
-			return
-		}
+// isTorrentDocument reports whether an uploaded document is a .torrent file
+func isTorrentDocument(doc *tgbotapi.Document) bool {
+	if doc == nil {
+		return false
+	}
+	return strings.EqualFold(filepath.Ext(doc.FileName), ".torrent") ||
+		doc.MimeType == "application/x-bittorrent"
+}
+
+// Examples shown when a typed selection cannot be parsed
+const selectionHelp = "Examples:\n" +
+	"1,3,5 or 1-10 - file numbers and ranges\n" +
+	"*.mkv - files matching a pattern\n" +
+	"video, audio, subs, images, docs, archives - file types\n" +
+	">100MB or <1GB - size filters\n" +
+	"!*.nfo or all -3 - exclude files\n" +
+	"all - every file"
+
+// handleFileSelection processes file selection typed by the user instead of using the picker
+func (b *Bot) handleFileSelection(message *tgbotapi.Message, session *UserSession) {
+	chatID := message.Chat.ID
+	selection := strings.TrimSpace(message.Text)
 
-		fileIDs = append(fileIDs, fileID)
+	job := session.Pending
+	if job == nil {
+		session.State = StateNone
+		msg := tgbotapi.NewMessage(chatID, "There is no torrent waiting for a selection. Send a magnet link to start.")
+		b.Sender.Send(msg)
+		return
 	}
 
-	// Apply selection
-	err := session.Downloader.SelectFiles(fileIDs)
+	fileIDs, err := ParseSelection(selection, job.Files)
 	if err != nil {
+		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Invalid selection: %v\n\n%s", err, selectionHelp))
+		b.Sender.Send(msg)
+		return
+	}
+
+	b.confirmSelection(chatID, session, job, fileIDs)
+}
+
+// confirmSelection applies the selection, closes the picker and queues the job
+func (b *Bot) confirmSelection(chatID int64, session *UserSession, job *Job, fileIDs []int) {
+	size := sumSizes(job.Files, fileIDs)
+	if err := b.checkSizeQuota(job, size); err != nil {
+		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Selection refused: %v. Pick fewer files or check /quota.", err))
+		b.Sender.Send(msg)
+		return
+	}
+	if err := b.checkDiskSpace(job, size); err != nil {
+		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Selection refused: %v. Pick fewer files or try again later.", err))
+		b.Sender.Send(msg)
+		return
+	}
+
+	if err := job.Downloader.SelectFiles(fileIDs); err != nil {
 		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Error selecting files: %v", err))
-		b.Config.API.Send(msg)
+		b.Sender.Send(msg)
 		return
 	}
 
-	b.startDownload(message, session)
+	// Replacing the text without markup removes the keyboard
+	summary := fmt.Sprintf("%d of %d files selected, %s.", len(fileIDs), len(job.Files),
+		server.FormatBytes(size))
+	if job.Archive != server.ArchiveNone {
+		summary += fmt.Sprintf("\nFiles will be sent as one %s archive.", job.Archive)
+	}
+	if warning := uploadWarning(job, fileIDs, b.Config.AppConfig.MaxFileSize); warning != "" {
+		summary += "\n" + warning
+	}
+	updateMsg := tgbotapi.NewEditMessageText(chatID, job.PickerMsgID, jobHeader(job)+summary)
+	b.Sender.Send(updateMsg)
+
+	b.enqueueJob(chatID, session, job)
 }
 
-// startDownload begins the download process
-func (b *Bot) startDownload(message *tgbotapi.Message, session *UserSession) {
-	chatID := message.Chat.ID
+// enqueueJob hands a job with its selection to the queue and frees the session for the next link
+func (b *Bot) enqueueJob(chatID int64, session *UserSession, job *Job) {
+	session.Pending = nil
+	session.State = StateNone
 
-	// Send initial download message
-	msg := tgbotapi.NewMessage(chatID, "Starting download...")
-	sentMsg, err := b.Config.API.Send(msg)
+	// Send initial download message, it becomes the job's progress message
+	msg := tgbotapi.NewMessage(chatID, jobHeader(job)+"Queued for download...")
+	sentMsg, err := b.Sender.Send(msg)
 	if err != nil {
 		b.Logger.LogError("Error sending message: %v", err)
-		return
 	}
+	job.ProgressMsgID = sentMsg.MessageID
 
-	// Store progress message
-	session.ProgressMsg = &sentMsg
-	session.State = StateDownloading
+	if position := b.Jobs.Enqueue(job); position > 0 {
+		updateMsg := tgbotapi.NewEditMessageText(chatID, job.ProgressMsgID,
+			jobHeader(job)+fmt.Sprintf("Waiting for a free download slot (position %d in queue).\nUse /cancel %d to remove it.", position, job.ID))
+		b.Sender.Send(updateMsg)
+	}
+}
 
-	// Start download
-	progressChan, err := session.Downloader.Download()
+// runJob downloads and uploads a job once the queue gives it a slot
+func (b *Bot) runJob(job *Job) {
+	chatID := job.ChatID
+
+	// Start download, data already on disk does not count towards the quota
+	downloaded := job.Downloader.BytesCompleted()
+	progressChan, err := job.Downloader.Download()
 	if err != nil {
-		updateMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID,
-			fmt.Sprintf("Error starting download: %v", err))
-		b.Config.API.Send(updateMsg)
+		updateMsg := tgbotapi.NewEditMessageText(chatID, job.ProgressMsgID,
+			jobHeader(job)+fmt.Sprintf("Error starting download: %v", err))
+		b.Sender.Send(updateMsg)
+		b.Jobs.Finish(job, JobFailed)
 		return
 	}
 
 	// Monitor progress
-	go func() {
-		lastUpdate := time.Now()
-
-		for progress := range progressChan {
-			// Update UI every 3 seconds to avoid Telegram API rate limits
-			if time.Since(lastUpdate) >= 3*time.Second {
-				statusMsg := fmt.Sprintf("Status: %s\nProgress: %.2f%%\nDownloaded: %s / %s\nPeers: %d",
-					progress.Status,
-					progress.PercentComplete,
-					server.FormatBytes(progress.BytesCompleted),
-					server.FormatBytes(progress.BytesTotal),
-					progress.Peers)
-
-				updateMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, statusMsg)
-				b.Config.API.Send(updateMsg)
-				lastUpdate = time.Now()
+	lastUpdate := time.Now()
+	var overQuota error
+
+	for progress := range progressChan {
+		if delta := progress.BytesCompleted - downloaded; delta > 0 && overQuota == nil {
+			downloaded = progress.BytesCompleted
+			if err := b.chargeDownload(job, delta); err != nil {
+				// closing the downloader ends the progress channel
+				overQuota = err
+				b.Logger.LogInfo("Stopping job %d of user %d: %v", job.ID, job.UserID, err)
+				job.Downloader.Close()
 			}
 		}
 
-		// Download complete, get files
-		files, err := session.Downloader.GetDownloadedFiles()
-		if err != nil {
-			updateMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID,
-				fmt.Sprintf("Download failed: %v", err))
-			b.Config.API.Send(updateMsg)
-			return
+		// Update UI every 3 seconds, the sender drops edits that are outdated before their turn
+		if time.Since(lastUpdate) >= 3*time.Second {
+			status := progress.Status
+			if b.Engine.Paused() && status != "Completed" {
+				status = "Paused, low disk space"
+			}
+			statusMsg := fmt.Sprintf("Status: %s\nProgress: %.2f%%\nDownloaded: %s / %s\nPeers: %d",
+				status,
+				progress.PercentComplete,
+				server.FormatBytes(progress.BytesCompleted),
+				server.FormatBytes(progress.BytesTotal),
+				progress.Peers)
+
+			updateMsg := tgbotapi.NewEditMessageText(chatID, job.ProgressMsgID, jobHeader(job)+statusMsg)
+			b.Sender.SendProgress(updateMsg)
+			lastUpdate = time.Now()
 		}
+	}
 
-		// Send completion message
-		updateMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID,
-			fmt.Sprintf("Download complete! Uploading %d files...", len(files)))
-		b.Config.API.Send(updateMsg)
-
-		// Upload files to Telegram
-		b.uploadFiles(chatID, files)
+	b.saveUsage(job)
 
-		// Reset state
-		session.State = StateNone
-	}()
-}
+	// Shutdown closes the downloader too, the job stays stored and resumes after restart
+	if b.stopping() {
+		return
+	}
 
-// uploadFiles uploads downloaded files to Telegram
-func (b *Bot) uploadFiles(chatID int64, files []server.TorrentFile) {
-	for _, file := range files {
-		// Open the file
-		f, err := os.Open(file.Path)
-		if err != nil {
-			errorMsg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Error opening file: %v", err))
-			b.Config.API.Send(errorMsg)
-			continue
-		}
-		defer f.Close()
+	if overQuota != nil {
+		updateMsg := tgbotapi.NewEditMessageText(chatID, job.ProgressMsgID,
+			jobHeader(job)+fmt.Sprintf("Download stopped: %v. See /quota.", overQuota))
+		b.Sender.Send(updateMsg)
+		b.Janitor.Discard(job, "over quota")
+		b.Jobs.Finish(job, JobFailed)
+		return
+	}
 
-		// Create file upload
-		fileUpload := tgbotapi.FileReader{
-			Name:   file.Name,
-			Reader: f,
-		}
+	// Closing the downloader on /cancel ends the progress channel early
+	if job.Status() == JobCancelled {
+		updateMsg := tgbotapi.NewEditMessageText(chatID, job.ProgressMsgID, jobHeader(job)+"Cancelled.")
+		b.Sender.Send(updateMsg)
+		b.Janitor.Discard(job, "cancelled")
+		b.Jobs.Finish(job, JobCancelled)
+		return
+	}
 
-		// Check if it's a readable text file
-		fileExt := strings.ToLower(filepath.Ext(file.Name))
-		if isTextFile(fileExt) {
-			// Reset file pointer
-			f.Seek(0, 0)
-
-			// Read file content and send as text if small enough
-			content, err := io.ReadAll(f)
-			if err == nil && len(content) < 4096 { // Telegram message limit
-				textMsg := tgbotapi.NewMessage(chatID, fmt.Sprintf("File: %s\n\n```\n%s\n```", file.Name, string(content)))
-				textMsg.ParseMode = "Markdown"
-				b.Config.API.Send(textMsg)
-				continue // Skip document upload
-			}
-			f.Seek(0, 0) // Reset pointer again for document upload if needed
-		}
+	// Download complete, get files
+	files, err := job.Downloader.GetDownloadedFiles()
+	if err != nil {
+		updateMsg := tgbotapi.NewEditMessageText(chatID, job.ProgressMsgID,
+			jobHeader(job)+fmt.Sprintf("Download failed: %v", err))
+		b.Sender.Send(updateMsg)
+		job.Downloader.Close()
+		b.Janitor.Discard(job, "download failed")
+		b.Jobs.Finish(job, JobFailed)
+		return
+	}
 
-		// Send as document
-		doc := tgbotapi.NewDocument(chatID, fileUpload)
-		doc.Caption = fmt.Sprintf("File: %s", file.Name)
+	job.setStatus(JobUploading)
+	b.persistJob(job)
 
-		// Send the file
-		_, err = b.Config.API.Send(doc)
-		if err != nil {
-			b.Logger.LogError("Failed to upload file %s: %v", file.Name, err)
-			errorMsg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Error uploading file %s: %v", file.Name, err))
-			b.Config.API.Send(errorMsg)
-		}
+	var delivered bool
+	if job.Archive != server.ArchiveNone {
+		delivered = b.uploadArchive(job, files)
+	} else {
+		// Send completion message
+		updateMsg := tgbotapi.NewEditMessageText(chatID, job.ProgressMsgID,
+			jobHeader(job)+fmt.Sprintf("Download complete! Uploading %d files...", len(files)))
+		b.Sender.Send(updateMsg)
 
-		// Small delay between uploads
-		time.Sleep(1 * time.Second)
+		// Upload files to Telegram
+		delivered = b.uploadFiles(job, files)
 	}
 
-	// Send completion message
-	completeMsg := tgbotapi.NewMessage(chatID, "All files have been uploaded! Send another magnet link to download more files.")
-	b.Config.API.Send(completeMsg)
+	// the retention policy decides what happens to the data, seeding torrents stay open
+	if !b.Janitor.Keep(job, delivered) {
+		job.Downloader.Close()
+	}
+	b.Jobs.Finish(job, JobDone)
 }
 
-//  the file extension indicates a text file (able to upload)
-// TODO: Extend for audio files
-func isTextFile(ext string) bool {
-	textExtensions := map[string]bool{
-		".txt":  true,
-		".log":  true,
-		".md":   true,
-		".json": true,
-		".csv":  true,
-		".xml":  true,
-		".html": true,
-		".htm":  true,
-		".css":  true,
-		".js":   true,
-		".py":   true,
-		".go":   true,
-		".c":    true,
-		".cpp":  true,
-		".h":    true,
-		".java": true,
-		".php":  true,
-		".rb":   true,
-		".sh":   true,
-		".bat":  true,
-		".ps1":  true,
-		".yaml": true,
-		".yml":  true,
-		".toml": true,
-		".ini":  true,
-		".cfg":  true,
-		".conf": true,
-	}
-
-	return textExtensions[ext]
+// jobHeader is the first line of every message about a job
+func jobHeader(job *Job) string {
+	return fmt.Sprintf("%s - %s\n", job.Label(), job.Name())
 }
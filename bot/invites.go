@@ -0,0 +1,176 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Invites made without arguments are good for one user within two days
+const (
+	defaultInviteUses = 1
+	defaultInviteTTL  = 48 * time.Hour
+)
+
+// Redeem adds userID to the allowlist with the role of an invite code
+func (a *Access) Redeem(code string, userID int64) (Role, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	record, err := a.db.RedeemInvite(code, userID)
+	if err != nil {
+		return "", err
+	}
+	a.added[userID] = record
+	return Role(record.Role), nil
+}
+
+// redeemInvite handles /start <code> from someone not on the allowlist and
+// reports whether they were added
+func (b *Bot) redeemInvite(message *tgbotapi.Message) bool {
+	code := strings.TrimSpace(message.CommandArguments())
+	role, err := b.Access.Redeem(code, message.From.ID)
+
+	var reply string
+	switch {
+	case err == nil:
+		b.Logger.LogInfo("User %d (@%s) joined as %s with invite %s", message.From.ID, message.From.UserName, role, inviteTag(code))
+		return true
+	case errors.Is(err, server.ErrInviteExpired):
+		reply = "This invite has expired. Ask an admin for a new one."
+	case errors.Is(err, server.ErrInviteUsedUp):
+		reply = "This invite has already been used. Ask an admin for a new one."
+	case errors.Is(err, server.ErrInviteInvalid):
+		reply = fmt.Sprintf("This invite code is not valid. Ask an admin to add your user ID %d.", message.From.ID)
+	default:
+		b.Logger.LogError("Failed to redeem invite for user %d: %v", message.From.ID, err)
+		reply = "Could not redeem the invite, please try again later."
+	}
+
+	b.Logger.LogError("Rejected user %d (@%s) in chat %d: %v", message.From.ID, message.From.UserName, message.Chat.ID, err)
+	b.Sender.Send(tgbotapi.NewMessage(message.Chat.ID, reply))
+	return false
+}
+
+// createInvite handles /invite [uses] [hours] [role]
+func (b *Bot) createInvite(message *tgbotapi.Message) string {
+	const usage = "Usage: /invite [uses] [hours valid] [admin|user|readonly]"
+
+	invite := server.InviteRecord{
+		Role:      string(RoleUser),
+		MaxUses:   defaultInviteUses,
+		CreatedBy: message.From.ID,
+		CreatedAt: time.Now(),
+	}
+	ttl := defaultInviteTTL
+
+	fields := strings.Fields(message.CommandArguments())
+	if len(fields) > 3 {
+		return usage
+	}
+	if len(fields) > 0 {
+		uses, err := strconv.Atoi(fields[0])
+		if err != nil || uses < 1 {
+			return usage
+		}
+		invite.MaxUses = uses
+	}
+	if len(fields) > 1 {
+		hours, err := strconv.Atoi(fields[1])
+		if err != nil || hours < 1 {
+			return usage
+		}
+		ttl = time.Duration(hours) * time.Hour
+	}
+	if len(fields) > 2 {
+		role, ok := parseRole(fields[2])
+		if !ok {
+			return fmt.Sprintf("Unknown role %q, use admin, user or readonly.", fields[2])
+		}
+		invite.Role = string(role)
+	}
+	invite.ExpiresAt = invite.CreatedAt.Add(ttl).Truncate(time.Second)
+
+	code, err := server.NewInviteCode()
+	if err != nil {
+		return fmt.Sprintf("Could not create an invite: %v", err)
+	}
+	invite.Code = code
+	if err := b.DB.SaveInvite(invite); err != nil {
+		b.Logger.LogError("Failed to save invite: %v", err)
+		return fmt.Sprintf("Could not create an invite: %v", err)
+	}
+	b.Logger.LogInfo("User %d created invite %s (%s, %d uses)", message.From.ID, inviteTag(code), invite.Role, invite.MaxUses)
+
+	return fmt.Sprintf("Invite as %s, usable %d time(s) until %s:\nhttps://t.me/%s?start=%s\n\nOr send the bot: /start %s",
+		invite.Role, invite.MaxUses, invite.ExpiresAt.Format("2006-01-02 15:04 MST"),
+		b.Config.API.Self.UserName, code, code)
+}
+
+// listInvites handles /invites, expired invites are deleted on the way
+func (b *Bot) listInvites() string {
+	invites, err := b.DB.ListInvites()
+	if err != nil {
+		return fmt.Sprintf("Could not list invites: %v", err)
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].CreatedAt.Before(invites[j].CreatedAt) })
+
+	var lines []string
+	for _, invite := range invites {
+		if time.Now().After(invite.ExpiresAt) {
+			if err := b.DB.DeleteInvite(invite.Code); err != nil {
+				b.Logger.LogError("Failed to delete expired invite %s: %v", inviteTag(invite.Code), err)
+			}
+			continue
+		}
+		if !invite.Active() {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s - %s, %d of %d used, until %s",
+			invite.Code, invite.Role, invite.Uses, invite.MaxUses, invite.ExpiresAt.Format("2006-01-02 15:04")))
+	}
+
+	if len(lines) == 0 {
+		return "No active invites. Create one with /invite."
+	}
+	return "Active invites:\n" + strings.Join(lines, "\n")
+}
+
+// revokeInvite handles /revoke <code>
+func (b *Bot) revokeInvite(message *tgbotapi.Message) string {
+	code := strings.TrimSpace(message.CommandArguments())
+	if code == "" {
+		return "Usage: /revoke <invite code>"
+	}
+	if err := b.DB.DeleteInvite(code); err != nil {
+		return fmt.Sprintf("Could not revoke the invite: %v", err)
+	}
+	b.Logger.LogInfo("User %d revoked invite %s", message.From.ID, inviteTag(code))
+	return "Invite revoked."
+}
+
+// inviteTag is how an invite code appears in the log: enough of it to tell
+// invites apart, not enough to redeem one
+func inviteTag(code string) string {
+	if len(code) <= 4 {
+		return code
+	}
+	return code[:4] + "…"
+}
+
+// loggedText is the text of a message as it is logged, with invite codes shortened
+func loggedText(message *tgbotapi.Message) string {
+	switch message.Command() {
+	case "start", "revoke":
+		if code := strings.TrimSpace(message.CommandArguments()); code != "" {
+			return "/" + message.Command() + " " + inviteTag(code)
+		}
+	}
+	return message.Text
+}
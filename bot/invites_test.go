@@ -0,0 +1,33 @@
+package bot
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestLoggedText(t *testing.T) {
+	tests := []struct {
+		text    string
+		command int // length of the command entity, 0 for plain text
+		want    string
+	}{
+		{"/start AbCdEfGhIjKl", 6, "/start AbCd…"},
+		{"/start@TorrentBot AbCdEfGhIjKl", 17, "/start AbCd…"},
+		{"/revoke  AbCdEfGhIjKl ", 7, "/revoke AbCd…"},
+		{"/start", 6, "/start"},
+		{"/start abc", 6, "/start abc"},
+		{"/jobs", 5, "/jobs"},
+		{"/cancel 12", 7, "/cancel 12"},
+		{"AbCdEfGhIjKl", 0, "AbCdEfGhIjKl"},
+	}
+	for _, tt := range tests {
+		message := &tgbotapi.Message{Text: tt.text}
+		if tt.command > 0 {
+			message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: tt.command}}
+		}
+		if got := loggedText(message); got != tt.want {
+			t.Errorf("loggedText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
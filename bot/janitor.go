@@ -0,0 +1,563 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Retention policies, set with RETENTION_POLICY
+const (
+	retainForever = "forever"
+	retainUpload  = "upload" // remove once every file reached the chat
+	retainDays    = "days"   // remove RETENTION_DAYS after the download
+	retainSize    = "size"   // remove the least recently used data above RETENTION_MAX_SIZE_MB
+	retainRatio   = "ratio"  // seed until RETENTION_RATIO, then remove
+)
+
+// orphanGrace keeps the janitor away from data that may still be in use,
+// nothing changed more recently counts as orphaned
+const orphanGrace = 24 * time.Hour
+
+// scratchDirs hold temporary files of jobs in job-<id> directories
+var scratchDirs = []string{".archives"}
+
+// Janitor removes downloaded data according to the retention policy, and
+// data no job or download record accounts for. Admins get a report of what
+// was removed
+type Janitor struct {
+	bot    *Bot
+	policy string
+
+	mu      sync.Mutex
+	seeding map[int]*seed // by job ID, torrents kept open to reach the ratio
+}
+
+// seed is a finished torrent that keeps seeding under the ratio policy
+type seed struct {
+	downloader *server.Downloader
+	uploaded   int64 // seeded before the torrent was added in this process
+}
+
+func NewJanitor(b *Bot) *Janitor {
+	policy := b.Config.AppConfig.RetentionPolicy
+	switch policy {
+	case retainForever, retainUpload, retainDays, retainSize, retainRatio:
+	default:
+		b.Logger.LogError("Unknown RETENTION_POLICY %q, downloads are kept forever", policy)
+		policy = retainForever
+	}
+
+	return &Janitor{
+		bot:     b,
+		policy:  policy,
+		seeding: make(map[int]*seed),
+	}
+}
+
+// Keep records the data a finished job leaves in the download directory.
+// Under the upload policy delivered data is removed right away. Under the
+// ratio policy delivered torrents keep seeding and Keep returns true, the
+// caller then leaves the downloader open
+func (j *Janitor) Keep(job *Job, delivered bool) bool {
+	b := j.bot
+	record := j.record(job, delivered)
+
+	switch {
+	case j.policy == retainUpload && delivered && !(job.LinkLarge && b.Links != nil):
+		// links to large files stay valid, the sweep removes those once they expire
+		j.remove(record, "uploaded")
+		return false
+
+	case j.policy == retainRatio && delivered:
+		metainfo, err := job.Downloader.Metainfo()
+		if err != nil {
+			break
+		}
+		record.Metainfo = metainfo
+		if err := b.DB.SaveDownload(record); err != nil {
+			b.Logger.LogError("Failed to record download of job %d: %v", job.ID, err)
+		}
+
+		j.mu.Lock()
+		j.seeding[job.ID] = &seed{downloader: job.Downloader}
+		j.mu.Unlock()
+		b.Logger.LogInfo("Job %d keeps seeding until a ratio of %.2f", job.ID, b.Config.AppConfig.RetentionRatio)
+		return true
+	}
+
+	if err := b.DB.SaveDownload(record); err != nil {
+		b.Logger.LogError("Failed to record download of job %d: %v", job.ID, err)
+	}
+	return false
+}
+
+// record describes the data a job leaves in the download directory
+func (j *Janitor) record(job *Job, delivered bool) server.DownloadRecord {
+	job.mu.Lock()
+	charged := job.charged
+	job.mu.Unlock()
+
+	now := time.Now()
+	return server.DownloadRecord{
+		JobID:       job.ID,
+		ChatID:      job.ChatID,
+		UserID:      job.UserID,
+		Name:        job.Name(),
+		InfoHash:    job.Downloader.InfoHash(),
+		Paths:       j.jobPaths(job),
+		Size:        sumSizes(job.Files, job.Downloader.SelectedFiles()),
+		Charged:     charged,
+		Delivered:   delivered,
+		Hashes:      j.jobHashes(job),
+		CompletedAt: now,
+		LastAccess:  now,
+	}
+}
+
+// jobHashes returns the content hashes of the job's uploaded files by their record path
+func (j *Janitor) jobHashes(job *Job) map[string]string {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	var hashes map[string]string
+	for path, hash := range job.hashes {
+		if rel, ok := j.relPath(path); ok {
+			if hashes == nil {
+				hashes = make(map[string]string)
+			}
+			hashes[rel] = hash
+		}
+	}
+	return hashes
+}
+
+// Discard removes the data of a job that did not finish, it is not kept
+// under any policy. The user's storage quota gets the space back
+func (j *Janitor) Discard(job *Job, reason string) {
+	j.remove(j.record(job, false), reason)
+}
+
+// uncharge gives the bytes a record holds back to the user's storage quota,
+// once its data is removed
+func (j *Janitor) uncharge(record *server.DownloadRecord) {
+	if record.Charged <= 0 {
+		return
+	}
+	if _, err := j.bot.DB.AddUsage(record.UserID, 0, -record.Charged); err != nil {
+		j.bot.Logger.LogError("Failed to update usage of user %d: %v", record.UserID, err)
+		return
+	}
+	record.Charged = 0
+}
+
+// jobPaths returns the selected files of a job relative to the download directory
+func (j *Janitor) jobPaths(job *Job) []string {
+	root := j.bot.Config.AppConfig.DownloadPath
+	hash := job.Downloader.InfoHash()
+
+	var paths []string
+	for _, id := range job.Downloader.SelectedFiles() {
+		if id >= len(job.Files) {
+			continue
+		}
+		// GetDownloadedFiles turns the paths of downloaded files absolute, the
+		// others are relative to the torrent's directory, named after its info hash
+		path := job.Files[id].Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, hash, filepath.FromSlash(path))
+		}
+		if rel, ok := j.relPath(path); ok {
+			paths = append(paths, rel)
+		}
+	}
+	return paths
+}
+
+// relPath returns path relative to the download directory with '/' separators,
+// as download records hold it. Paths outside of it, such as archives, have none
+func (j *Janitor) relPath(path string) (string, bool) {
+	rel, err := filepath.Rel(j.bot.Config.AppConfig.DownloadPath, path)
+	if err != nil || !filepath.IsLocal(rel) || strings.HasPrefix(rel, ".") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// Run seeds the torrents left seeding before a restart and sweeps every
+// JANITOR_INTERVAL_MINUTES until stop is closed
+func (j *Janitor) Run(stop <-chan struct{}) {
+	if j.policy == retainRatio {
+		j.resumeSeeding()
+	}
+
+	ticker := time.NewTicker(j.bot.Config.AppConfig.JanitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			j.Sweep()
+		}
+	}
+}
+
+// Sweep applies the retention policy, removes orphaned data and reports it
+func (j *Janitor) Sweep() {
+	b := j.bot
+	cfg := b.Config.AppConfig
+
+	records, err := b.DB.ListDownloads()
+	if err != nil {
+		b.Logger.LogError("Janitor failed to list downloads: %v", err)
+		return
+	}
+
+	var removed []string
+	drop := func(record server.DownloadRecord, reason string) {
+		if line, ok := j.remove(record, reason); ok {
+			removed = append(removed, line)
+		}
+	}
+	expired := func(record server.DownloadRecord) bool {
+		return time.Since(record.CompletedAt) > time.Duration(cfg.RetentionDays)*24*time.Hour
+	}
+	days := fmt.Sprintf("older than %d days", cfg.RetentionDays)
+
+	switch j.policy {
+	case retainDays:
+		for _, record := range records {
+			if expired(record) {
+				drop(record, days)
+			}
+		}
+
+	case retainUpload:
+		for _, record := range records {
+			switch {
+			case record.Delivered && b.Links != nil && time.Since(record.CompletedAt) > cfg.LinkTTL:
+				drop(record, "uploaded, links expired")
+			case record.Delivered && b.Links == nil:
+				drop(record, "uploaded")
+			case expired(record):
+				drop(record, "not uploaded, "+days)
+			}
+		}
+
+	case retainSize:
+		// least recently used first
+		sort.Slice(records, func(a, c int) bool { return records[a].LastAccess.Before(records[c].LastAccess) })
+		var total int64
+		for _, record := range records {
+			total += record.Size
+		}
+		for _, record := range records {
+			if total <= cfg.RetentionMaxSize {
+				break
+			}
+			total -= record.Size
+			drop(record, fmt.Sprintf("over the size cap of %s", server.FormatBytes(cfg.RetentionMaxSize)))
+		}
+
+	case retainRatio:
+		for _, record := range records {
+			if reason := j.checkRatio(record, expired(record)); reason != "" {
+				drop(record, reason)
+			}
+		}
+	}
+
+	removed = append(removed, j.removeOrphans()...)
+	j.report(removed)
+}
+
+// checkRatio stops seeding a record once it reached the ratio, or is older
+// than RETENTION_DAYS so a torrent nobody wants does not seed forever.
+// Returns why the record is to be removed, empty to keep it
+func (j *Janitor) checkRatio(record server.DownloadRecord, expired bool) string {
+	b := j.bot
+	target := b.Config.AppConfig.RetentionRatio
+
+	j.mu.Lock()
+	s := j.seeding[record.JobID]
+	j.mu.Unlock()
+
+	switch {
+	case s == nil && !record.Delivered:
+		return "not uploaded"
+	case s == nil && expired:
+		return "not seeding"
+	case s == nil:
+		return ""
+	}
+
+	uploaded := s.uploaded + s.downloader.UploadedBytes()
+	var ratio float64
+	if record.Size > 0 {
+		ratio = float64(uploaded) / float64(record.Size)
+	}
+
+	reason := ""
+	switch {
+	case ratio >= target:
+		reason = fmt.Sprintf("seeded to a ratio of %.2f", ratio)
+	case expired:
+		reason = fmt.Sprintf("seeded to a ratio of %.2f in %d days", ratio, b.Config.AppConfig.RetentionDays)
+	default:
+		if uploaded != record.Uploaded {
+			record.Uploaded = uploaded
+			if err := b.DB.SaveDownload(record); err != nil {
+				b.Logger.LogError("Failed to save seeding progress of job %d: %v", record.JobID, err)
+			}
+		}
+		return ""
+	}
+
+	j.mu.Lock()
+	delete(j.seeding, record.JobID)
+	j.mu.Unlock()
+	s.downloader.Close()
+	return reason
+}
+
+// remove deletes the files of a record that no other download or job uses,
+// drops the record and gives the space back to the user's storage quota.
+// Nothing is removed when it cannot be told which files are in use
+func (j *Janitor) remove(record server.DownloadRecord, reason string) (string, bool) {
+	b := j.bot
+
+	inUse, err := j.pathsInUse(record.JobID)
+	if err != nil {
+		b.Logger.LogError("Keeping download of job %d, failed to list downloads: %v", record.JobID, err)
+		return "", false
+	}
+	var paths []string
+	for _, path := range record.Paths {
+		if !inUse[path] {
+			paths = append(paths, path)
+		}
+	}
+
+	freed, err := server.RemoveFiles(b.Config.AppConfig.DownloadPath, paths)
+	if err != nil {
+		b.Logger.LogError("Failed to remove files of job %d: %v", record.JobID, err)
+	}
+	if err := b.DB.DeleteDownload(record.JobID); err != nil {
+		b.Logger.LogError("Failed to delete download record of job %d: %v", record.JobID, err)
+	}
+	j.uncharge(&record)
+
+	line := fmt.Sprintf("#%d %s (%s, %s)", record.JobID, record.Name, server.FormatBytes(freed), reason)
+	b.Logger.LogInfo("Removed download %s", line)
+	return line, true
+}
+
+// pathsInUse collects the files of every download record and unfinished job except jobID
+func (j *Janitor) pathsInUse(jobID int) (map[string]bool, error) {
+	records, err := j.bot.DB.ListDownloads()
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := make(map[string]bool)
+	for _, record := range records {
+		if record.JobID == jobID {
+			continue
+		}
+		for _, path := range record.Paths {
+			inUse[path] = true
+		}
+	}
+
+	for _, job := range j.bot.Jobs.ActiveJobs() {
+		if job.ID == jobID || job.Downloader == nil || job.Files == nil {
+			continue
+		}
+		for _, path := range j.jobPaths(job) {
+			inUse[path] = true
+		}
+	}
+	return inUse, nil
+}
+
+// removeOrphans deletes temporary files of finished jobs and, with
+// JANITOR_REMOVE_UNTRACKED, anything at the top of the download directory no
+// download record or job accounts for. Hidden entries such as the databases
+// are left alone
+func (j *Janitor) removeOrphans() []string {
+	b := j.bot
+	root := b.Config.AppConfig.DownloadPath
+
+	active := make(map[int]bool)
+	for _, job := range b.Jobs.ActiveJobs() {
+		active[job.ID] = true
+	}
+
+	var removed []string
+	for _, dir := range scratchDirs {
+		entries, _ := os.ReadDir(filepath.Join(root, dir))
+		for _, entry := range entries {
+			var id int
+			if _, err := fmt.Sscanf(entry.Name(), "job-%d", &id); err == nil && active[id] {
+				continue
+			}
+			if line, ok := j.removeOrphan(filepath.Join(root, dir, entry.Name()), dir+"/"+entry.Name(), "temporary files of a finished job"); ok {
+				removed = append(removed, line)
+			}
+		}
+	}
+
+	if !b.Config.AppConfig.JanitorRemoveUntracked {
+		return removed
+	}
+
+	// top level names of everything in use, and of the log and database paths
+	inUse, err := j.pathsInUse(-1)
+	if err != nil {
+		b.Logger.LogError("Janitor failed to list downloads: %v", err)
+		return removed
+	}
+	kept := make(map[string]bool)
+	for path := range inUse {
+		kept[strings.SplitN(path, "/", 2)[0]] = true
+	}
+	for _, path := range []string{b.Config.AppConfig.LogPath, b.Config.AppConfig.DatabasePath} {
+		if rel, err := filepath.Rel(root, path); err == nil && filepath.IsLocal(rel) {
+			kept[strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]] = true
+		}
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		b.Logger.LogError("Janitor failed to read %s: %v", root, err)
+		return removed
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || kept[name] {
+			continue
+		}
+		if line, ok := j.removeOrphan(filepath.Join(root, name), name, "not part of any download"); ok {
+			removed = append(removed, line)
+		}
+	}
+	return removed
+}
+
+// removeOrphan deletes path unless something in it changed within orphanGrace
+func (j *Janitor) removeOrphan(path, name, reason string) (string, bool) {
+	if time.Since(lastModified(path)) < orphanGrace {
+		return "", false
+	}
+
+	size := server.DiskUsage(path)
+	if err := os.RemoveAll(path); err != nil {
+		j.bot.Logger.LogError("Failed to remove orphaned %s: %v", path, err)
+		return "", false
+	}
+
+	line := fmt.Sprintf("%s (%s, %s)", name, server.FormatBytes(size), reason)
+	j.bot.Logger.LogInfo("Removed orphaned %s", line)
+	return line, true
+}
+
+// lastModified returns the newest modification time of path and everything below it
+func lastModified(path string) time.Time {
+	var latest time.Time
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
+
+// report tells the admins what a sweep removed
+func (j *Janitor) report(removed []string) {
+	if len(removed) == 0 {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Cleanup removed %d items:\n", len(removed)))
+	for _, line := range removed {
+		if sb.Len()+len(line) > summaryLength {
+			sb.WriteString("…")
+			break
+		}
+		sb.WriteString(line + "\n")
+	}
+
+	for _, adminID := range j.bot.Access.Admins() {
+		if _, err := j.bot.Sender.Send(tgbotapi.NewMessage(adminID, sb.String())); err != nil {
+			j.bot.Logger.LogError("Failed to send cleanup report to %d: %v", adminID, err)
+		}
+	}
+}
+
+// resumeSeeding adds the torrents that were seeding before a restart again
+func (j *Janitor) resumeSeeding() {
+	b := j.bot
+	records, err := b.DB.ListDownloads()
+	if err != nil {
+		b.Logger.LogError("Janitor failed to list downloads: %v", err)
+		return
+	}
+
+	for _, record := range records {
+		if !record.Delivered || record.Metainfo == nil {
+			continue
+		}
+
+		downloader := server.NewDownloader(b.Engine, b.Logger)
+		if _, err := downloader.GetTorrentInfoFromFile(bytes.NewReader(record.Metainfo)); err != nil {
+			b.Logger.LogError("Failed to resume seeding job %d: %v", record.JobID, err)
+			downloader.Close()
+			continue
+		}
+
+		j.mu.Lock()
+		j.seeding[record.JobID] = &seed{downloader: downloader, uploaded: record.Uploaded}
+		j.mu.Unlock()
+		b.Logger.LogInfo("Seeding job %d (%s) again", record.JobID, record.Name)
+	}
+}
+
+// SaveSeeding stores how much each seeding torrent uploaded, for the ratio after a restart
+func (j *Janitor) SaveSeeding() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.seeding) == 0 {
+		return
+	}
+
+	records, err := j.bot.DB.ListDownloads()
+	if err != nil {
+		j.bot.Logger.LogError("Janitor failed to list downloads: %v", err)
+		return
+	}
+	for _, record := range records {
+		s, ok := j.seeding[record.JobID]
+		if !ok {
+			continue
+		}
+		record.Uploaded = s.uploaded + s.downloader.UploadedBytes()
+		if err := j.bot.DB.SaveDownload(record); err != nil {
+			j.bot.Logger.LogError("Failed to save seeding progress of job %d: %v", record.JobID, err)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package bot
+
+import (
+	"BotTelegram/config"
+	"BotTelegram/server"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newJanitorBot returns a bot with a download directory and database of its own
+func newJanitorBot(t *testing.T, cfg config.Config) *Bot {
+	t.Helper()
+	root := t.TempDir()
+	logger, err := server.NewLogger(filepath.Join(root, "logs"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logger.Close() })
+	db, err := server.OpenDatabase(filepath.Join(root, ".bot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cfg.DownloadPath = root
+	cfg.LogPath = filepath.Join(root, "logs")
+	cfg.DatabasePath = filepath.Join(root, ".bot.db")
+	if cfg.RetentionDays == 0 {
+		cfg.RetentionDays = 7
+	}
+
+	// no admins, so sweeps send no reports
+	b := &Bot{Config: &BotConfig{AppConfig: &cfg}, Logger: logger, DB: db, Access: &Access{}}
+	b.Jobs = NewJobQueue(1, 1, db.NextJobID, func(*Job) {}, func(*Job) {})
+	b.Janitor = NewJanitor(b)
+	return b
+}
+
+// writeFiles creates files of size bytes below the download directory, modified age ago
+func writeFiles(t *testing.T, b *Bot, age time.Duration, size int, rels ...string) {
+	t.Helper()
+	for _, rel := range rels {
+		path := filepath.Join(b.Config.AppConfig.DownloadPath, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modified := time.Now().Add(-age)
+		for dir := path; dir != b.Config.AppConfig.DownloadPath; dir = filepath.Dir(dir) {
+			if err := os.Chtimes(dir, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// saveDownload stores a record of paths completed age ago and charges it to the user
+func saveDownload(t *testing.T, b *Bot, record server.DownloadRecord, age time.Duration) server.DownloadRecord {
+	t.Helper()
+	id, err := b.DB.NextJobID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.JobID = id
+	record.CompletedAt = time.Now().Add(-age)
+	if record.LastAccess.IsZero() {
+		record.LastAccess = record.CompletedAt
+	}
+	if record.Charged > 0 {
+		if _, err := b.DB.AddUsage(record.UserID, record.Charged, record.Charged); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.DB.SaveDownload(record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// recordIDs returns the job IDs of the stored download records
+func recordIDs(t *testing.T, b *Bot) []int {
+	t.Helper()
+	records, err := b.DB.ListDownloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, record := range records {
+		ids = append(ids, record.JobID)
+	}
+	return ids
+}
+
+// checkExists fails for each path below the download directory that does not match exists
+func checkExists(t *testing.T, b *Bot, exists bool, rels ...string) {
+	t.Helper()
+	for _, rel := range rels {
+		_, err := os.Stat(filepath.Join(b.Config.AppConfig.DownloadPath, filepath.FromSlash(rel)))
+		if exists && err != nil {
+			t.Errorf("%s was removed: %v", rel, err)
+		}
+		if !exists && !os.IsNotExist(err) {
+			t.Errorf("%s is still there: %v", rel, err)
+		}
+	}
+}
+
+func storedBytes(t *testing.T, b *Bot, userID int64) int64 {
+	t.Helper()
+	usage, err := b.DB.Usage(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usage.StoredBytes
+}
+
+const day = 24 * time.Hour
+
+func TestJanitorDays(t *testing.T) {
+	b := newJanitorBot(t, config.Config{RetentionPolicy: retainDays})
+	writeFiles(t, b, 10*day, 100, "Old/a.mkv", "Old/a.srt")
+	writeFiles(t, b, day, 100, "New/b.mkv")
+	saveDownload(t, b, server.DownloadRecord{UserID: 1, Paths: []string{"Old/a.mkv", "Old/a.srt"}, Size: 200, Charged: 200}, 8*day)
+	kept := saveDownload(t, b, server.DownloadRecord{UserID: 1, Paths: []string{"New/b.mkv"}, Size: 100, Charged: 100}, day)
+
+	b.Janitor.Sweep()
+
+	checkExists(t, b, false, "Old")
+	checkExists(t, b, true, "New/b.mkv")
+	if ids := recordIDs(t, b); !slices.Equal(ids, []int{kept.JobID}) {
+		t.Errorf("records %v left, want only #%d", ids, kept.JobID)
+	}
+	if stored := storedBytes(t, b, 1); stored != 100 {
+		t.Errorf("stored bytes = %d after removing 200 of 300, want 100", stored)
+	}
+}
+
+func TestJanitorSharedPaths(t *testing.T) {
+	// the same torrent downloaded twice with different selections
+	b := newJanitorBot(t, config.Config{RetentionPolicy: retainDays})
+	writeFiles(t, b, 10*day, 100, "Show/E01.mkv", "Show/E02.mkv")
+	first := saveDownload(t, b, server.DownloadRecord{UserID: 1, Paths: []string{"Show/E01.mkv", "Show/E02.mkv"}, Charged: 200}, 8*day)
+	second := saveDownload(t, b, server.DownloadRecord{UserID: 2, Paths: []string{"Show/E01.mkv"}, Charged: 100}, day)
+
+	b.Janitor.Sweep()
+
+	checkExists(t, b, false, "Show/E02.mkv")
+	checkExists(t, b, true, "Show/E01.mkv")
+	if ids := recordIDs(t, b); !slices.Equal(ids, []int{second.JobID}) {
+		t.Errorf("records %v left, want only #%d", ids, second.JobID)
+	}
+	if stored := storedBytes(t, b, 1); stored != 0 {
+		t.Errorf("stored bytes of the first user = %d, want 0", stored)
+	}
+
+	// the file goes with the last record holding it, and the empty folder with it
+	second.CompletedAt = time.Now().Add(-8 * day)
+	if err := b.DB.SaveDownload(second); err != nil {
+		t.Fatal(err)
+	}
+	b.Janitor.Sweep()
+	checkExists(t, b, false, "Show")
+	if ids := recordIDs(t, b); len(ids) != 0 {
+		t.Errorf("records %v left, want none", ids)
+	}
+	if first.JobID == second.JobID {
+		t.Errorf("both downloads got job ID %d", first.JobID)
+	}
+}
+
+func TestJanitorUpload(t *testing.T) {
+	b := newJanitorBot(t, config.Config{RetentionPolicy: retainUpload})
+	writeFiles(t, b, day, 10, "Sent/a", "Waiting/b", "Stale/c")
+	saveDownload(t, b, server.DownloadRecord{Paths: []string{"Sent/a"}, Delivered: true}, time.Hour)
+	waiting := saveDownload(t, b, server.DownloadRecord{Paths: []string{"Waiting/b"}}, day)
+	saveDownload(t, b, server.DownloadRecord{Paths: []string{"Stale/c"}}, 8*day)
+
+	b.Janitor.Sweep()
+
+	checkExists(t, b, false, "Sent", "Stale")
+	checkExists(t, b, true, "Waiting/b")
+	if ids := recordIDs(t, b); !slices.Equal(ids, []int{waiting.JobID}) {
+		t.Errorf("records %v left, want only #%d", ids, waiting.JobID)
+	}
+}
+
+func TestJanitorSize(t *testing.T) {
+	b := newJanitorBot(t, config.Config{RetentionPolicy: retainSize, RetentionMaxSize: 35})
+	writeFiles(t, b, day, 10, "A/a", "B/b", "C/c")
+	now := time.Now()
+	// B was used least recently, then A
+	saveDownload(t, b, server.DownloadRecord{Paths: []string{"A/a"}, Size: 20, LastAccess: now.Add(-2 * time.Hour)}, day)
+	saveDownload(t, b, server.DownloadRecord{Paths: []string{"B/b"}, Size: 10, LastAccess: now.Add(-3 * time.Hour)}, day)
+	recent := saveDownload(t, b, server.DownloadRecord{Paths: []string{"C/c"}, Size: 30, LastAccess: now}, day)
+
+	b.Janitor.Sweep()
+
+	checkExists(t, b, false, "A", "B")
+	checkExists(t, b, true, "C/c")
+	if ids := recordIDs(t, b); !slices.Equal(ids, []int{recent.JobID}) {
+		t.Errorf("records %v left, want only #%d", ids, recent.JobID)
+	}
+}
+
+func TestJanitorRatioWithoutSeeding(t *testing.T) {
+	b := newJanitorBot(t, config.Config{RetentionPolicy: retainRatio, RetentionRatio: 1})
+	writeFiles(t, b, day, 10, "Failed/a", "Seeded/b", "Expired/c")
+	saveDownload(t, b, server.DownloadRecord{Paths: []string{"Failed/a"}}, time.Hour)
+	seeded := saveDownload(t, b, server.DownloadRecord{Paths: []string{"Seeded/b"}, Delivered: true}, day)
+	saveDownload(t, b, server.DownloadRecord{Paths: []string{"Expired/c"}, Delivered: true}, 8*day)
+
+	b.Janitor.Sweep()
+
+	checkExists(t, b, false, "Failed", "Expired")
+	checkExists(t, b, true, "Seeded/b")
+	if ids := recordIDs(t, b); !slices.Equal(ids, []int{seeded.JobID}) {
+		t.Errorf("records %v left, want only #%d", ids, seeded.JobID)
+	}
+}
+
+func TestJanitorForever(t *testing.T) {
+	b := newJanitorBot(t, config.Config{RetentionPolicy: retainForever})
+	writeFiles(t, b, 100*day, 10, "Kept/a")
+	record := saveDownload(t, b, server.DownloadRecord{UserID: 1, Paths: []string{"Kept/a"}, Charged: 10}, 100*day)
+
+	b.Janitor.Sweep()
+
+	checkExists(t, b, true, "Kept/a")
+	records, err := b.DB.ListDownloads()
+	if err != nil || len(records) != 1 || records[0].JobID != record.JobID {
+		t.Fatalf("records = %v, %v, want #%d kept", records, err, record.JobID)
+	}
+	// the data stays, and so does its charge
+	if records[0].Charged != 10 || storedBytes(t, b, 1) != 10 {
+		t.Errorf("charged %d, stored bytes %d, want 10 kept", records[0].Charged, storedBytes(t, b, 1))
+	}
+}
+
+func TestJanitorForeverKeepsQuota(t *testing.T) {
+	b := newJanitorBot(t, config.Config{RetentionPolicy: retainForever, QuotaStorage: 100})
+
+	first, err := b.Jobs.NewJob(1, 1, &server.Downloader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.chargeDownload(first, 80); err != nil {
+		t.Fatal(err)
+	}
+	b.saveUsage(first)
+	b.Janitor.Keep(first, true)
+	b.Janitor.Sweep()
+
+	if stored := storedBytes(t, b, 1); stored != 80 {
+		t.Errorf("stored bytes = %d after the download finished, want 80", stored)
+	}
+	second, err := b.Jobs.NewJob(1, 1, &server.Downloader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.checkSizeQuota(second, 50); err == nil {
+		t.Error("a second download of 50 bytes fit in 100 with 80 kept forever")
+	}
+}
+
+func TestJanitorOrphans(t *testing.T) {
+	for _, removeUntracked := range []bool{false, true} {
+		b := newJanitorBot(t, config.Config{RetentionPolicy: retainDays, JanitorRemoveUntracked: removeUntracked})
+		active, err := b.Jobs.NewJob(1, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writeFiles(t, b, 2*day, 10,
+			".archives/job-98/show.zip",
+			".archives/job-"+strconv.Itoa(active.ID)+"/movie.tar.gz",
+			"Tracked/a",
+			"Untracked/b",
+			".hidden/c",
+		)
+		writeFiles(t, b, time.Hour, 10, "Fresh/d")
+		saveDownload(t, b, server.DownloadRecord{Paths: []string{"Tracked/a"}}, day)
+
+		b.Janitor.Sweep()
+
+		// scratch files of jobs that are gone, never those of running jobs
+		checkExists(t, b, false, ".archives/job-98")
+		checkExists(t, b, true, ".archives/job-"+strconv.Itoa(active.ID), "Tracked/a", "Fresh/d", ".hidden/c", ".bot.db", "logs")
+		checkExists(t, b, !removeUntracked, "Untracked")
+	}
+}
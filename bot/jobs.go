@@ -0,0 +1,412 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobStatus represents where a torrent job is in its lifecycle
+type JobStatus int
+
+const (
+	JobFetching JobStatus = iota
+	JobSelecting
+	JobQueued
+	JobDownloading
+	JobUploading
+	JobDone
+	JobFailed
+	JobCancelled
+)
+
+func (s JobStatus) String() string {
+	switch s {
+	case JobFetching:
+		return "Fetching metadata"
+	case JobSelecting:
+		return "Selecting files"
+	case JobQueued:
+		return "Queued"
+	case JobDownloading:
+		return "Downloading"
+	case JobUploading:
+		return "Uploading"
+	case JobDone:
+		return "Done"
+	case JobFailed:
+		return "Failed"
+	case JobCancelled:
+		return "Cancelled"
+	default:
+		return "Unknown"
+	}
+}
+
+// Finished reports whether the job no longer holds any resources
+func (s JobStatus) Finished() bool {
+	return s == JobDone || s == JobFailed || s == JobCancelled
+}
+
+// Job is a single torrent requested by a user
+type Job struct {
+	ID            int
+	ChatID        int64
+	UserID        int64 // who sent the torrent, its downloads count towards their quota
+	MagnetLink    string
+	Downloader    *server.Downloader
+	Files         []server.TorrentFile
+	ProgressMsgID int
+	PickerMsgID   int
+	Archive       server.ArchiveFormat // bundle the files before upload, empty to send them one by one
+	LinkLarge     bool                 // send a download link for files over the upload limit instead of parts
+
+	// file picker state while the job is selecting
+	uploadLimit int64
+	canLink     bool // the HTTP server is on, so large files can be sent as links
+	picked      []bool
+	tree        *fileTree
+	dir         string
+	page        int
+
+	mu       sync.Mutex
+	status   JobStatus
+	name     string
+	uploaded map[int]bool // file IDs already sent, skipped when the upload is resumed
+	charged  int64        // downloaded bytes counted towards the user's quota
+	unsaved  int64        // part of charged not yet added to the stored usage
+	savedAt  time.Time
+	hashes   map[string]string // content hashes of uploaded files by path, see contentHash
+}
+
+// Status returns the current status of the job
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+func (j *Job) setStatus(status JobStatus) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = status
+}
+
+// Name returns the torrent name once metadata is known
+func (j *Job) Name() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.name == "" {
+		return "(fetching metadata)"
+	}
+	return j.name
+}
+
+func (j *Job) setName(name string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.name = name
+}
+
+// markUploaded records that file id has been sent
+func (j *Job) markUploaded(id int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.uploaded == nil {
+		j.uploaded = make(map[int]bool)
+	}
+	j.uploaded[id] = true
+}
+
+func (j *Job) isUploaded(id int) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.uploaded[id]
+}
+
+// uploadedFiles returns the sent file IDs in order
+func (j *Job) uploadedFiles() []int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ids := make([]int, 0, len(j.uploaded))
+	for id := range j.uploaded {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Label is the short prefix used in messages about this job
+func (j *Job) Label() string {
+	return fmt.Sprintf("Job #%d", j.ID)
+}
+
+// ErrNoJob is returned when a chat has no job with the requested ID
+var ErrNoJob = errors.New("no such job")
+
+// JobQueue tracks every unfinished job and starts queued ones within the
+// concurrency limits. Jobs are forgotten once they finish
+type JobQueue struct {
+	mu         sync.Mutex
+	jobs       map[int]*Job
+	queued     []*Job
+	running    map[int64]int // downloading jobs by user ID
+	active     int
+	maxActive  int
+	maxPerUser int
+	newID      func() (int, error)
+	run        func(*Job)
+	changed    func(*Job)
+	stopped    bool
+	wg         sync.WaitGroup
+}
+
+// NewJobQueue creates a queue that calls run in its own goroutine for every job that gets a slot.
+// New jobs get their IDs from newID, changed is called after every status change the queue makes
+func NewJobQueue(maxActive, maxPerUser int, newID func() (int, error), run, changed func(*Job)) *JobQueue {
+	return &JobQueue{
+		jobs:       make(map[int]*Job),
+		running:    make(map[int64]int),
+		maxActive:  maxActive,
+		maxPerUser: maxPerUser,
+		newID:      newID,
+		run:        run,
+		changed:    changed,
+	}
+}
+
+// NewJob registers a new job userID sent in chatID
+func (q *JobQueue) NewJob(chatID, userID int64, downloader *server.Downloader) (*Job, error) {
+	id, err := q.newID()
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := &Job{
+		ID:         id,
+		ChatID:     chatID,
+		UserID:     userID,
+		Downloader: downloader,
+		status:     JobFetching,
+	}
+	q.jobs[job.ID] = job
+	return job, nil
+}
+
+// Restore registers a job loaded from the database under its old ID
+func (q *JobQueue) Restore(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.jobs[job.ID] = job
+}
+
+// Enqueue marks the job as ready to download. Returns its position in the queue, 0 if it started right away
+func (q *JobQueue) Enqueue(job *Job) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job.setStatus(JobQueued)
+	q.changed(job)
+	q.queued = append(q.queued, job)
+	q.schedule()
+
+	for i, queued := range q.queued {
+		if queued == job {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Finish releases the slot held by a running job and starts the next ones
+func (q *JobQueue) Finish(job *Job, status JobStatus) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job.Status() != JobCancelled {
+		job.setStatus(status)
+	}
+	q.changed(job)
+	q.release(job)
+	delete(q.jobs, job.ID)
+	q.schedule()
+}
+
+// Fail marks a job that never reached the queue as failed and forgets it
+func (q *JobQueue) Fail(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job.setStatus(JobFailed)
+	q.changed(job)
+	delete(q.jobs, job.ID)
+}
+
+// Cancel stops a job of chatID whatever state it is in
+func (q *JobQueue) Cancel(chatID int64, id int) (*Job, error) {
+	job, err := q.cancel(chatID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// closed without q.mu, releasing the torrent must not hold up the queue
+	if job.Downloader != nil {
+		job.Downloader.Close()
+	}
+	return job, nil
+}
+
+// cancel marks a job cancelled and takes it out of the queue
+func (q *JobQueue) cancel(chatID int64, id int) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok || job.ChatID != chatID {
+		return nil, fmt.Errorf("%w #%d", ErrNoJob, id)
+	}
+
+	status := job.Status()
+	if status.Finished() {
+		return nil, fmt.Errorf("job #%d is already %s", id, status)
+	}
+
+	job.setStatus(JobCancelled)
+	q.changed(job)
+	if status == JobQueued {
+		q.removeQueued(job)
+	}
+
+	// running jobs release their slot through Finish once their goroutine notices
+	if status != JobDownloading && status != JobUploading {
+		delete(q.jobs, job.ID)
+		q.schedule()
+	}
+	return job, nil
+}
+
+// ActiveJobs returns every unfinished job
+func (q *JobQueue) ActiveJobs() []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.collect(func(job *Job) bool { return !job.Status().Finished() })
+}
+
+// UserActiveJobs returns the unfinished jobs sent by userID, in any chat
+func (q *JobQueue) UserActiveJobs(userID int64) []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.collect(func(job *Job) bool { return job.UserID == userID && !job.Status().Finished() })
+}
+
+// Job returns the job id of chatID
+func (q *JobQueue) Job(chatID int64, id int) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok || job.ChatID != chatID {
+		return nil, fmt.Errorf("%w #%d", ErrNoJob, id)
+	}
+	return job, nil
+}
+
+// UserJobs returns the jobs of chatID in creation order
+func (q *JobQueue) UserJobs(chatID int64) []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.collect(func(job *Job) bool { return job.ChatID == chatID })
+}
+
+// Stop keeps queued jobs from starting and returns every unfinished job
+func (q *JobQueue) Stop() []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.stopped = true
+	return q.collect(func(job *Job) bool { return !job.Status().Finished() })
+}
+
+// Wait blocks until every running job returned or timeout passed. Reports whether they all returned
+func (q *JobQueue) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// schedule starts queued jobs while slots are free. Caller holds q.mu
+func (q *JobQueue) schedule() {
+	if q.stopped {
+		return
+	}
+
+	for i := 0; i < len(q.queued) && q.active < q.maxActive; {
+		job := q.queued[i]
+		if q.running[job.UserID] >= q.maxPerUser {
+			i++
+			continue
+		}
+
+		q.queued = append(q.queued[:i], q.queued[i+1:]...)
+		q.active++
+		q.running[job.UserID]++
+		job.setStatus(JobDownloading)
+		q.changed(job)
+
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			q.run(job)
+		}()
+	}
+}
+
+// release gives back the slots of a job. Caller holds q.mu
+func (q *JobQueue) release(job *Job) {
+	q.active--
+	q.running[job.UserID]--
+	if q.running[job.UserID] <= 0 {
+		delete(q.running, job.UserID)
+	}
+}
+
+// collect returns the jobs keep accepts in ID order, which is creation order. Caller holds q.mu
+func (q *JobQueue) collect(keep func(*Job) bool) []*Job {
+	var jobs []*Job
+	for _, job := range q.jobs {
+		if keep(job) {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].ID < jobs[b].ID })
+	return jobs
+}
+
+// removeQueued drops job from the waiting list. Caller holds q.mu
+func (q *JobQueue) removeQueued(job *Job) {
+	for i, queued := range q.queued {
+		if queued == job {
+			q.queued = append(q.queued[:i], q.queued[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobQueuePerUserLimit(t *testing.T) {
+	started := make(chan *Job, 3)
+	q := NewJobQueue(3, 1, counter(), func(job *Job) { started <- job }, func(*Job) {})
+
+	// the same user in a private chat and in a group shares one slot
+	private := newJob(t, q, 100, 100)
+	group := newJob(t, q, -200, 100)
+	other := newJob(t, q, -200, 300)
+
+	if position := q.Enqueue(private); position != 0 {
+		t.Fatalf("first job queued at %d, want it started", position)
+	}
+	if position := q.Enqueue(group); position != 1 {
+		t.Errorf("second job of the user at %d, want it queued first", position)
+	}
+	if position := q.Enqueue(other); position != 0 {
+		t.Errorf("job of another user in the group queued at %d, want it started", position)
+	}
+	if got := group.Status(); got != JobQueued {
+		t.Errorf("second job of the user is %s, want queued", got)
+	}
+
+	// the two running jobs may start in either order
+	<-started
+	<-started
+	q.Finish(private, JobDone)
+	if job := <-started; job != group {
+		t.Errorf("job #%d started after the user's slot was freed, want #%d", job.ID, group.ID)
+	}
+	q.Finish(other, JobDone)
+	q.Finish(group, JobDone)
+	if !q.Wait(time.Second) {
+		t.Error("job goroutines did not return")
+	}
+}
+
+// counter hands out job IDs like the database does, starting at 1
+func counter() func() (int, error) {
+	id := 0
+	return func() (int, error) {
+		id++
+		return id, nil
+	}
+}
+
+func newJob(t *testing.T, q *JobQueue, chatID, userID int64) *Job {
+	t.Helper()
+	job, err := q.NewJob(chatID, userID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestJobQueueForgetsFinishedJobs(t *testing.T) {
+	started := make(chan *Job, 2)
+	q := NewJobQueue(2, 2, counter(), func(job *Job) { started <- job }, func(*Job) {})
+
+	done := newJob(t, q, 1, 1)
+	running := newJob(t, q, 1, 1)
+	selecting := newJob(t, q, 1, 1)
+	failed := newJob(t, q, 1, 1)
+	q.Enqueue(done)
+	q.Enqueue(running)
+	<-started
+	<-started
+
+	q.Finish(done, JobDone)
+	if _, err := q.Cancel(1, selecting.ID); err != nil {
+		t.Fatal(err)
+	}
+	q.Fail(failed)
+
+	// a running job that is cancelled stays until its goroutine finishes it
+	if _, err := q.Cancel(1, running.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(q.jobs); n != 1 {
+		t.Errorf("%d jobs kept, want only the running one", n)
+	}
+	q.Finish(running, JobCancelled)
+	if n := len(q.jobs); n != 0 {
+		t.Errorf("%d jobs kept after every job finished, want none", n)
+	}
+	if _, err := q.Job(1, done.ID); err == nil {
+		t.Errorf("finished job #%d can still be looked up", done.ID)
+	}
+}
@@ -0,0 +1,408 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Entries shown per page of the picker, Telegram allows 100 buttons per keyboard
+const pickerPageSize = 10
+
+// Longest file name shown on a button before it is shortened
+const pickerNameLength = 40
+
+// Callback data is "f:<job id>:<action>:<arg>", Telegram allows 64 bytes.
+// Entry actions take the index of the entry in the open directory
+const (
+	pickerToggle   = "t"
+	pickerOpen     = "o"
+	pickerUp       = "u"
+	pickerAll      = "a"
+	pickerNone     = "n"
+	pickerPage     = "p"
+	pickerArchive  = "z"
+	pickerLink     = "l"
+	pickerDownload = "d"
+	pickerCancel   = "x"
+	pickerNoop     = "-"
+)
+
+func pickerData(jobID int, action string, arg int) string {
+	return fmt.Sprintf("f:%d:%s:%d", jobID, action, arg)
+}
+
+// parsePickerData splits callback data made by pickerData
+func parsePickerData(data string) (jobID int, action string, arg int, err error) {
+	parts := strings.Split(data, ":")
+	if len(parts) != 4 || parts[0] != "f" {
+		return 0, "", 0, fmt.Errorf("unknown callback data %q", data)
+	}
+	if jobID, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, "", 0, err
+	}
+	if arg, err = strconv.Atoi(parts[3]); err != nil {
+		return 0, "", 0, err
+	}
+	return jobID, parts[2], arg, nil
+}
+
+// initPicker starts a picker for a job with every file selected, showing the torrent root
+func initPicker(job *Job) {
+	job.picked = make([]bool, len(job.Files))
+	for i := range job.picked {
+		job.picked[i] = true
+	}
+	job.tree = buildFileTree(job.Files)
+	job.dir = ""
+	job.page = 0
+}
+
+// pickerText is the message shown above the picker keyboard
+func pickerText(job *Job) string {
+	var sb strings.Builder
+	sb.WriteString(jobHeader(job))
+	sb.WriteString(fmt.Sprintf("%d of %d files selected, %s of %s.\n",
+		countPicked(job), len(job.Files),
+		server.FormatBytes(sumSizes(job.Files, pickedFiles(job))), server.FormatBytes(totalSize(job.Files))))
+	if warning := uploadWarning(job, pickedFiles(job), job.uploadLimit); warning != "" {
+		sb.WriteString(warning + "\n")
+	}
+	if job.dir != "" {
+		sb.WriteString(fmt.Sprintf("Folder: /%s\n", job.dir))
+	}
+	sb.WriteString("\nTap files or folders to toggle them, › opens a folder. Press Download when ready.\n")
+	sb.WriteString("You can also type a selection such as '1-10', '*.mkv', 'video !*sample*' or 'all'.")
+	return sb.String()
+}
+
+// pickerKeyboard renders the current page of the open directory
+func pickerKeyboard(job *Job) tgbotapi.InlineKeyboardMarkup {
+	entries := job.tree.find(job.dir).entries()
+	pages := pickerPages(len(entries))
+	if job.page >= pages {
+		job.page = pages - 1
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+
+	if job.dir != "" {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⬆ ..", pickerData(job.ID, pickerUp, 0)),
+		))
+	}
+
+	start := job.page * pickerPageSize
+	end := start + pickerPageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+	for i := start; i < end; i++ {
+		entry := entries[i]
+		if entry.dir != nil {
+			picked := countPickedOf(job, entry.dir.all)
+			label := fmt.Sprintf("%s 📁 %s (%d/%d, %s)", selectionMark(picked, len(entry.dir.all)),
+				shortenName(entry.dir.name, pickerNameLength), picked, len(entry.dir.all),
+				server.FormatBytes(sumSizes(job.Files, entry.dir.all)))
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(label, pickerData(job.ID, pickerToggle, i)),
+				tgbotapi.NewInlineKeyboardButtonData("›", pickerData(job.ID, pickerOpen, i)),
+			))
+			continue
+		}
+
+		picked := 0
+		if job.picked[entry.file] {
+			picked = 1
+		}
+		name := path.Base(job.Files[entry.file].Name)
+		label := fmt.Sprintf("%s %d. %s (%s)", selectionMark(picked, 1), entry.file+1,
+			shortenName(name, pickerNameLength), server.FormatBytes(job.Files[entry.file].Size))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label, pickerData(job.ID, pickerToggle, i)),
+		))
+	}
+
+	if pages > 1 {
+		var nav []tgbotapi.InlineKeyboardButton
+		if job.page > 0 {
+			nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("« Prev", pickerData(job.ID, pickerPage, job.page-1)))
+		}
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData(
+			fmt.Sprintf("%d/%d", job.page+1, pages), pickerData(job.ID, pickerNoop, 0)))
+		if job.page < pages-1 {
+			nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("Next »", pickerData(job.ID, pickerPage, job.page+1)))
+		}
+		rows = append(rows, nav)
+	}
+
+	// how to deliver files over the upload limit, only asked when there are some
+	if job.canLink && job.Archive == server.ArchiveNone && uploadWarning(job, pickedFiles(job), job.uploadLimit) != "" {
+		label := "✂ Large files: split into parts"
+		if job.LinkLarge {
+			label = "🔗 Large files: send link"
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label, pickerData(job.ID, pickerLink, 0)),
+		))
+	}
+
+	rows = append(rows,
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Select all", pickerData(job.ID, pickerAll, 0)),
+			tgbotapi.NewInlineKeyboardButtonData("Select none", pickerData(job.ID, pickerNone, 0)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📦 Send as: "+archiveLabel(job.Archive), pickerData(job.ID, pickerArchive, 0)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⬇ Download", pickerData(job.ID, pickerDownload, 0)),
+			tgbotapi.NewInlineKeyboardButtonData("✖ Cancel", pickerData(job.ID, pickerCancel, 0)),
+		),
+	)
+
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// selectionMark shows whether all, some or none of a group is selected
+func selectionMark(picked, total int) string {
+	switch {
+	case picked == 0:
+		return "⬜"
+	case picked == total:
+		return "✅"
+	default:
+		return "➖"
+	}
+}
+
+func pickerPages(entries int) int {
+	pages := (entries + pickerPageSize - 1) / pickerPageSize
+	if pages == 0 {
+		return 1
+	}
+	return pages
+}
+
+func countPicked(job *Job) int {
+	count := 0
+	for _, picked := range job.picked {
+		if picked {
+			count++
+		}
+	}
+	return count
+}
+
+// countPickedOf counts the selected files among fileIDs
+func countPickedOf(job *Job, fileIDs []int) int {
+	count := 0
+	for _, id := range fileIDs {
+		if job.picked[id] {
+			count++
+		}
+	}
+	return count
+}
+
+// pickedFiles returns the file IDs ticked in the picker
+func pickedFiles(job *Job) []int {
+	var fileIDs []int
+	for i, picked := range job.picked {
+		if picked {
+			fileIDs = append(fileIDs, i)
+		}
+	}
+	return fileIDs
+}
+
+// sumSizes adds up the sizes of fileIDs, an empty selection is zero
+func sumSizes(files []server.TorrentFile, fileIDs []int) int64 {
+	var total int64
+	for _, id := range fileIDs {
+		total += files[id].Size
+	}
+	return total
+}
+
+// totalSize is the size of the whole torrent
+func totalSize(files []server.TorrentFile) int64 {
+	var total int64
+	for _, file := range files {
+		total += file.Size
+	}
+	return total
+}
+
+// sizeWarning tells which selected files cannot be uploaded in one piece, empty if all fit
+func sizeWarning(files []server.TorrentFile, fileIDs []int, limit int64, delivery string) string {
+	var count int
+	var largest int64
+	for _, id := range fileIDs {
+		if files[id].Size > limit {
+			count++
+			if files[id].Size > largest {
+				largest = files[id].Size
+			}
+		}
+	}
+
+	if count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("⚠ %d selected files are larger than the %s upload limit and will be sent %s (largest %s).",
+		count, server.FormatBytes(limit), delivery, server.FormatBytes(largest))
+}
+
+// uploadWarning warns about what will be split on upload: single files, or the archive when the job bundles them
+func uploadWarning(job *Job, fileIDs []int, limit int64) string {
+	if job.Archive == server.ArchiveNone {
+		if job.LinkLarge {
+			return sizeWarning(job.Files, fileIDs, limit, "as download links")
+		}
+		return sizeWarning(job.Files, fileIDs, limit, "in parts")
+	}
+	if total := sumSizes(job.Files, fileIDs); total > limit {
+		return fmt.Sprintf("⚠ The selection is larger than the %s upload limit, the archive will be sent in parts.",
+			server.FormatBytes(limit))
+	}
+	return ""
+}
+
+// archiveFormats is the order the archive button cycles through
+var archiveFormats = []server.ArchiveFormat{server.ArchiveNone, server.ArchiveZip, server.ArchiveTarGz}
+
+func archiveLabel(format server.ArchiveFormat) string {
+	if format == server.ArchiveNone {
+		return "separate files"
+	}
+	return format.Ext()[1:] + " archive"
+}
+
+// nextArchiveFormat returns the format after current in archiveFormats
+func nextArchiveFormat(current server.ArchiveFormat) server.ArchiveFormat {
+	for i, format := range archiveFormats {
+		if format == current {
+			return archiveFormats[(i+1)%len(archiveFormats)]
+		}
+	}
+	return server.ArchiveNone
+}
+
+// shortenName keeps the start and the extension of long names
+func shortenName(name string, max int) string {
+	runes := []rune(name)
+	if len(runes) <= max {
+		return name
+	}
+	tail := 10
+	return string(runes[:max-tail-1]) + "…" + string(runes[len(runes)-tail:])
+}
+
+// handleCallback processes presses on the file picker keyboard
+func (b *Bot) handleCallback(query *tgbotapi.CallbackQuery) {
+	if query.Message == nil {
+		return
+	}
+	chatID := query.Message.Chat.ID
+
+	jobID, action, arg, err := parsePickerData(query.Data)
+	if err != nil {
+		b.Logger.LogError("Invalid callback from %d: %v", chatID, err)
+		b.answerCallback(query, "")
+		return
+	}
+
+	session := b.getSession(chatID)
+	job := session.Pending
+	if job == nil || job.ID != jobID || job.Status() != JobSelecting {
+		b.answerCallback(query, "This file list is no longer active.")
+		return
+	}
+
+	entries := job.tree.find(job.dir).entries()
+
+	switch action {
+	case pickerToggle:
+		if arg < 0 || arg >= len(entries) {
+			break
+		}
+		if dir := entries[arg].dir; dir != nil {
+			// a folder is selected as a whole, partially selected folders get completed
+			selectAll := countPickedOf(job, dir.all) < len(dir.all)
+			for _, id := range dir.all {
+				job.picked[id] = selectAll
+			}
+		} else {
+			job.picked[entries[arg].file] = !job.picked[entries[arg].file]
+		}
+
+	case pickerOpen:
+		if arg >= 0 && arg < len(entries) && entries[arg].dir != nil {
+			job.dir = entries[arg].dir.path
+			job.page = 0
+		}
+
+	case pickerUp:
+		job.dir = path.Dir(job.dir)
+		if job.dir == "." {
+			job.dir = ""
+		}
+		job.page = 0
+
+	case pickerAll, pickerNone:
+		for i := range job.picked {
+			job.picked[i] = action == pickerAll
+		}
+
+	case pickerPage:
+		if arg >= 0 && arg < pickerPages(len(entries)) {
+			job.page = arg
+		}
+
+	case pickerArchive:
+		job.Archive = nextArchiveFormat(job.Archive)
+
+	case pickerLink:
+		job.LinkLarge = !job.LinkLarge && job.canLink
+
+	case pickerNoop:
+		b.answerCallback(query, "")
+		return
+
+	case pickerCancel:
+		b.Jobs.Cancel(chatID, job.ID)
+		session.Pending = nil
+		session.State = StateNone
+		b.answerCallback(query, "Cancelled")
+		updateMsg := tgbotapi.NewEditMessageText(chatID, query.Message.MessageID, jobHeader(job)+"Cancelled.")
+		b.Sender.Send(updateMsg)
+		return
+
+	case pickerDownload:
+		fileIDs := pickedFiles(job)
+		if len(fileIDs) == 0 {
+			b.Sender.Request(tgbotapi.NewCallbackWithAlert(query.ID, "Select at least one file."))
+			return
+		}
+
+		b.answerCallback(query, "")
+		b.confirmSelection(chatID, session, job, fileIDs)
+		return
+	}
+
+	b.answerCallback(query, "")
+	updateMsg := tgbotapi.NewEditMessageTextAndMarkup(chatID, query.Message.MessageID, pickerText(job), pickerKeyboard(job))
+	b.Sender.Send(updateMsg)
+}
+
+// answerCallback stops the loading spinner on the pressed button
+func (b *Bot) answerCallback(query *tgbotapi.CallbackQuery, text string) {
+	if _, err := b.Sender.Request(tgbotapi.NewCallback(query.ID, text)); err != nil {
+		b.Logger.LogError("Failed to answer callback: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// mediaKind is the Telegram method a file is sent with
+type mediaKind int
+
+const (
+	mediaDocument mediaKind = iota
+	mediaPhoto
+	mediaVideo
+	mediaAudio
+)
+
+// String is the name stored with cached file_ids
+func (k mediaKind) String() string {
+	switch k {
+	case mediaPhoto:
+		return "photo"
+	case mediaVideo:
+		return "video"
+	case mediaAudio:
+		return "audio"
+	}
+	return "document"
+}
+
+func parseMediaKind(s string) mediaKind {
+	for _, kind := range []mediaKind{mediaPhoto, mediaVideo, mediaAudio} {
+		if kind.String() == s {
+			return kind
+		}
+	}
+	return mediaDocument
+}
+
+// Telegram limits for sendPhoto, bigger images go as documents
+const (
+	maxPhotoSize       = 10 << 20
+	maxPhotoDimensions = 10000 // width + height
+	maxPhotoRatio      = 20
+)
+
+// Photos per album, sendMediaGroup takes 2 to 10 items
+const mediaGroupSize = 10
+
+// mediaTypes covers the extensions the system MIME table may not know
+var mediaTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+}
+
+// mediaKindOf picks the send method from the file's MIME type. Only formats
+// Telegram clients play inline are sent as media, e.g. MKV stays a document
+func mediaKindOf(name string) mediaKind {
+	ext := strings.ToLower(filepath.Ext(name))
+	mimeType, ok := mediaTypes[ext]
+	if !ok {
+		mimeType = mime.TypeByExtension(ext)
+	}
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+
+	switch mimeType {
+	case "video/mp4", "video/x-m4v", "video/quicktime":
+		return mediaVideo
+	case "audio/mpeg", "audio/mp3", "audio/mp4", "audio/x-m4a":
+		return mediaAudio
+	case "image/jpeg", "image/png":
+		return mediaPhoto
+	}
+	return mediaDocument
+}
+
+// isPhoto reports whether file can go through sendPhoto
+func (b *Bot) isPhoto(file server.TorrentFile, size int64) bool {
+	if mediaKindOf(file.Name) != mediaPhoto || size > maxPhotoSize {
+		return false
+	}
+	info, err := b.Prober.Probe(file.Path)
+	if err != nil || info.Width == 0 || info.Height == 0 {
+		return false
+	}
+	long, short := info.Width, info.Height
+	if short > long {
+		long, short = short, long
+	}
+	return info.Width+info.Height <= maxPhotoDimensions && long <= short*maxPhotoRatio
+}
+
+// sendMedia sends one file with the method matching its kind
+func (b *Bot) sendMedia(chatID int64, kind mediaKind, file server.TorrentFile, upload tgbotapi.RequestFileData, caption string) (tgbotapi.Message, error) {
+	switch kind {
+	case mediaPhoto:
+		photo := tgbotapi.NewPhoto(chatID, upload)
+		photo.Caption = caption
+		return b.Sender.Send(photo)
+
+	case mediaVideo:
+		return b.sendVideo(chatID, file, upload, caption)
+
+	case mediaAudio:
+		return b.Sender.Send(b.audioConfig(chatID, file, upload, caption))
+	}
+
+	doc := tgbotapi.NewDocument(chatID, upload)
+	doc.Caption = caption
+	return b.Sender.Send(doc)
+}
+
+// audioConfig builds the sendAudio request with the probed duration, title and performer
+func (b *Bot) audioConfig(chatID int64, file server.TorrentFile, upload tgbotapi.RequestFileData, caption string) tgbotapi.AudioConfig {
+	audio := tgbotapi.NewAudio(chatID, upload)
+	audio.Caption = caption
+	if _, cached := upload.(tgbotapi.FileID); cached {
+		// Telegram keeps the details of files it already has
+		return audio
+	}
+
+	info, err := b.Prober.Probe(file.Path)
+	if err != nil {
+		b.Logger.LogError("Failed to probe %s: %v", file.Name, err)
+	}
+	audio.Duration = info.Duration
+	audio.Title = info.Title
+	audio.Performer = info.Performer
+	if audio.Title == "" {
+		audio.Title = strings.TrimSuffix(filepath.Base(file.Name), filepath.Ext(file.Name))
+	}
+	return audio
+}
+
+// sendVideo calls sendVideo directly, VideoConfig has no width and height fields
+func (b *Bot) sendVideo(chatID int64, file server.TorrentFile, upload tgbotapi.RequestFileData, caption string) (tgbotapi.Message, error) {
+	params, files, cleanup, err := b.videoRequest(chatID, file, upload, caption)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	defer cleanup()
+
+	resp, err := b.Sender.UploadFiles("sendVideo", params, files)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	var msg tgbotapi.Message
+	err = json.Unmarshal(resp.Result, &msg)
+	return msg, err
+}
+
+// videoRequest builds the sendVideo parameters and files. Duration, size and
+// thumbnail are attached when the prober can read them, cleanup removes the thumbnail
+func (b *Bot) videoRequest(chatID int64, file server.TorrentFile, upload tgbotapi.RequestFileData, caption string) (tgbotapi.Params, []tgbotapi.RequestFile, func(), error) {
+	params := tgbotapi.Params{}
+	params["chat_id"] = strconv.FormatInt(chatID, 10)
+	params.AddNonEmpty("caption", caption)
+	params.AddBool("supports_streaming", true)
+
+	files := []tgbotapi.RequestFile{{Name: "video", Data: upload}}
+	cleanup := func() {}
+
+	// Telegram keeps the details and thumbnail of videos it already has
+	if _, cached := upload.(tgbotapi.FileID); !cached {
+		info, err := b.Prober.Probe(file.Path)
+		if err != nil {
+			b.Logger.LogError("Failed to probe %s: %v", file.Name, err)
+		}
+		params.AddNonZero("duration", info.Duration)
+		params.AddNonZero("width", info.Width)
+		params.AddNonZero("height", info.Height)
+
+		dir, err := os.MkdirTemp("", "thumb-")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		cleanup = func() { os.RemoveAll(dir) }
+
+		// thumbnails are always uploaded, even with a local Bot API server
+		thumb := filepath.Join(dir, "thumb.jpg")
+		switch err := b.Prober.Thumbnail(file.Path, thumb); {
+		case err == nil:
+			files = append(files, tgbotapi.RequestFile{Name: "thumb", Data: diskFile{path: thumb, name: "thumb.jpg"}})
+		case !errors.Is(err, server.ErrNoThumbnail):
+			b.Logger.LogError("Failed to make thumbnail for %s: %v", file.Name, err)
+		}
+	}
+	return params, files, cleanup, nil
+}
+
+// sendAlbum sends 2 to 10 photos as one media group, uploads[i] holds the data of files[i]
+func (b *Bot) sendAlbum(chatID int64, files []server.TorrentFile, uploads []tgbotapi.RequestFileData) ([]tgbotapi.Message, error) {
+	media := make([]interface{}, 0, len(files))
+	for i, file := range files {
+		photo := tgbotapi.NewInputMediaPhoto(uploads[i])
+		photo.Caption = fmt.Sprintf("File: %s", file.Name)
+		media = append(media, photo)
+	}
+
+	return b.Sender.SendMediaGroup(tgbotapi.NewMediaGroup(chatID, media))
+}
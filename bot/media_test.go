@@ -0,0 +1,247 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fakeProber returns canned media details instead of running ffprobe
+type fakeProber struct {
+	info     map[string]server.MediaInfo // by path, missing paths fail to probe
+	thumbErr error                       // returned by Thumbnail, nil writes a fake JPEG
+	probed   []string
+}
+
+func (p *fakeProber) Probe(path string) (server.MediaInfo, error) {
+	p.probed = append(p.probed, path)
+	info, ok := p.info[path]
+	if !ok {
+		return server.MediaInfo{}, errors.New("cannot probe " + path)
+	}
+	return info, nil
+}
+
+func (p *fakeProber) Thumbnail(path, dest string) error {
+	if p.thumbErr != nil {
+		return p.thumbErr
+	}
+	return os.WriteFile(dest, []byte("\xff\xd8fake jpeg"), 0644)
+}
+
+func newMediaBot(t *testing.T, prober *fakeProber) *Bot {
+	t.Helper()
+	logger, err := server.NewLogger(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logger.Close() })
+	return &Bot{Logger: logger, Prober: prober}
+}
+
+func TestMediaKindOf(t *testing.T) {
+	tests := map[string]mediaKind{
+		"a/Movie.MP4":  mediaVideo,
+		"clip.mov":     mediaVideo,
+		"clip.m4v":     mediaVideo,
+		"movie.mkv":    mediaDocument,
+		"song.mp3":     mediaAudio,
+		"song.m4a":     mediaAudio,
+		"song.flac":    mediaDocument,
+		"cover.jpeg":   mediaPhoto,
+		"cover.PNG":    mediaPhoto,
+		"anim.gif":     mediaDocument,
+		"readme":       mediaDocument,
+		"notes.txt":    mediaDocument,
+		"archive.zip":  mediaDocument,
+		"photo.jpg.gz": mediaDocument,
+	}
+	for name, want := range tests {
+		if got := mediaKindOf(name); got != want {
+			t.Errorf("mediaKindOf(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestIsPhoto(t *testing.T) {
+	prober := &fakeProber{info: map[string]server.MediaInfo{
+		"/d/photo.jpg":    {Width: 4000, Height: 3000},
+		"/d/portrait.png": {Width: 1080, Height: 1920},
+		"/d/huge.jpg":     {Width: 8000, Height: 6000},
+		"/d/banner.png":   {Width: 4200, Height: 200},
+		"/d/strip.png":    {Width: 100, Height: 2001},
+		"/d/nosize.jpg":   {},
+	}}
+	b := newMediaBot(t, prober)
+
+	tests := []struct {
+		path string
+		size int64
+		want bool
+	}{
+		{"/d/photo.jpg", 5 << 20, true},
+		{"/d/portrait.png", 1 << 20, true},
+		{"/d/photo.jpg", maxPhotoSize, true},
+		{"/d/photo.jpg", maxPhotoSize + 1, false}, // over the sendPhoto size limit
+		{"/d/huge.jpg", 1 << 20, false},           // width + height over 10000
+		{"/d/banner.png", 1 << 20, false},         // ratio over 20
+		{"/d/strip.png", 1 << 20, false},          // ratio over 20, standing
+		{"/d/nosize.jpg", 1 << 20, false},         // dimensions unknown
+		{"/d/missing.jpg", 1 << 20, false},        // probe fails
+	}
+	for _, tt := range tests {
+		file := server.TorrentFile{Name: tt.path[3:], Path: tt.path}
+		if got := b.isPhoto(file, tt.size); got != tt.want {
+			t.Errorf("isPhoto(%s, %d) = %v, want %v", tt.path, tt.size, got, tt.want)
+		}
+	}
+
+	// other kinds are decided by name without probing
+	prober.probed = nil
+	if b.isPhoto(server.TorrentFile{Name: "clip.mp4", Path: "/d/clip.mp4"}, 1<<20) || len(prober.probed) != 0 {
+		t.Errorf("isPhoto(clip.mp4) probed %v", prober.probed)
+	}
+}
+
+func TestAudioConfig(t *testing.T) {
+	prober := &fakeProber{info: map[string]server.MediaInfo{
+		"/d/tagged.mp3":   {Duration: 215, Title: "Song", Performer: "Band"},
+		"/d/untagged.mp3": {Duration: 61},
+	}}
+	b := newMediaBot(t, prober)
+	upload := diskFile{path: "/d/tagged.mp3", name: "tagged.mp3"}
+
+	audio := b.audioConfig(42, server.TorrentFile{Name: "Album/tagged.mp3", Path: "/d/tagged.mp3"}, upload, "File: tagged.mp3")
+	if audio.ChatID != 42 || audio.Caption != "File: tagged.mp3" || audio.Duration != 215 ||
+		audio.Title != "Song" || audio.Performer != "Band" {
+		t.Errorf("tagged: got %+v", audio)
+	}
+
+	// without a title tag the file name without extension is shown
+	audio = b.audioConfig(42, server.TorrentFile{Name: "Album/02 Intro.mp3", Path: "/d/untagged.mp3"}, upload, "")
+	if audio.Duration != 61 || audio.Title != "02 Intro" || audio.Performer != "" {
+		t.Errorf("untagged: got %+v", audio)
+	}
+
+	// a failed probe still sends the audio
+	audio = b.audioConfig(42, server.TorrentFile{Name: "x.mp3", Path: "/d/missing.mp3"}, upload, "")
+	if audio.Duration != 0 || audio.Title != "x" {
+		t.Errorf("probe failed: got %+v", audio)
+	}
+
+	// files Telegram has are sent by ID without probing
+	prober.probed = nil
+	audio = b.audioConfig(42, server.TorrentFile{Name: "tagged.mp3", Path: "/d/tagged.mp3"}, tgbotapi.FileID("abc"), "")
+	if len(prober.probed) != 0 || audio.Duration != 0 || audio.Title != "" {
+		t.Errorf("cached: probed %v, got %+v", prober.probed, audio)
+	}
+}
+
+func TestVideoRequest(t *testing.T) {
+	prober := &fakeProber{info: map[string]server.MediaInfo{
+		"/d/movie.mp4": {Duration: 5400, Width: 1920, Height: 800},
+	}}
+	b := newMediaBot(t, prober)
+	file := server.TorrentFile{Name: "movie.mp4", Path: "/d/movie.mp4"}
+	upload := diskFile{path: file.Path, name: "movie.mp4"}
+
+	params, files, cleanup, err := b.videoRequest(-100123, file, upload, "File: movie.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := tgbotapi.Params{
+		"chat_id":            "-100123",
+		"caption":            "File: movie.mp4",
+		"supports_streaming": "true",
+		"duration":           "5400",
+		"width":              "1920",
+		"height":             "800",
+	}
+	if !maps.Equal(params, want) {
+		t.Errorf("params = %v, want %v", params, want)
+	}
+	if names := fileNames(files); !slices.Equal(names, []string{"video", "thumb"}) {
+		t.Fatalf("files = %v, want video and thumb", names)
+	}
+	if files[0].Data != upload {
+		t.Errorf("video data = %v, want the upload", files[0].Data)
+	}
+
+	// the thumbnail is read from disk until cleanup
+	name, reader, err := files[1].Data.UploadData()
+	if err != nil || name != "thumb.jpg" {
+		t.Fatalf("thumb = %q, %v", name, err)
+	}
+	data, _ := io.ReadAll(reader)
+	reader.(io.Closer).Close()
+	if string(data) != "\xff\xd8fake jpeg" {
+		t.Errorf("thumb data = %q", data)
+	}
+	thumb := files[1].Data.(diskFile).path
+	cleanup()
+	if _, err := os.Stat(thumb); !os.IsNotExist(err) {
+		t.Errorf("thumbnail %s left after cleanup: %v", thumb, err)
+	}
+}
+
+func TestVideoRequestWithoutDetails(t *testing.T) {
+	// no ffmpeg: the header prober cannot make thumbnails, and this file cannot be probed
+	prober := &fakeProber{thumbErr: server.ErrNoThumbnail}
+	b := newMediaBot(t, prober)
+	file := server.TorrentFile{Name: "clip.mov", Path: "/d/clip.mov"}
+
+	params, files, cleanup, err := b.videoRequest(7, file, diskFile{path: file.Path, name: "clip.mov"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	want := tgbotapi.Params{"chat_id": "7", "supports_streaming": "true"}
+	if !maps.Equal(params, want) {
+		t.Errorf("params = %v, want %v", params, want)
+	}
+	if names := fileNames(files); !slices.Equal(names, []string{"video"}) {
+		t.Errorf("files = %v, want only the video", names)
+	}
+
+	// a failing ffmpeg is logged, the video still goes out
+	prober.thumbErr = errors.New("ffmpeg crashed")
+	_, files, cleanup, err = b.videoRequest(7, file, diskFile{path: file.Path, name: "clip.mov"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if names := fileNames(files); !slices.Equal(names, []string{"video"}) {
+		t.Errorf("files = %v, want only the video", names)
+	}
+}
+
+func TestVideoRequestCached(t *testing.T) {
+	prober := &fakeProber{info: map[string]server.MediaInfo{"/d/movie.mp4": {Duration: 10}}}
+	b := newMediaBot(t, prober)
+
+	params, files, cleanup, err := b.videoRequest(7, server.TorrentFile{Name: "movie.mp4", Path: "/d/movie.mp4"}, tgbotapi.FileID("abc"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if len(prober.probed) != 0 {
+		t.Errorf("probed %v for a cached video", prober.probed)
+	}
+	if _, ok := params["duration"]; ok || len(files) != 1 {
+		t.Errorf("cached video sent details: params %v, files %v", params, fileNames(files))
+	}
+}
+
+func fileNames(files []tgbotapi.RequestFile) []string {
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Name
+	}
+	return names
+}
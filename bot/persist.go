@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"bytes"
+	"fmt"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// persistJob mirrors a job into the database so it survives a restart.
+// Jobs are stored once files are selected and removed when they finish
+func (b *Bot) persistJob(job *Job) {
+	status := job.Status()
+
+	if status.Finished() {
+		if err := b.DB.DeleteJob(job.ID); err != nil {
+			b.Logger.LogError("Failed to delete job %d: %v", job.ID, err)
+		}
+		return
+	}
+	if status < JobQueued {
+		return
+	}
+
+	metainfo, err := job.Downloader.Metainfo()
+	if err != nil {
+		b.Logger.LogError("Failed to persist job %d: %v", job.ID, err)
+		return
+	}
+
+	record := server.JobRecord{
+		ID:            job.ID,
+		ChatID:        job.ChatID,
+		UserID:        job.UserID,
+		Name:          job.Name(),
+		MagnetLink:    job.MagnetLink,
+		InfoHash:      job.Downloader.InfoHash(),
+		Metainfo:      metainfo,
+		SelectedFiles: job.Downloader.SelectedFiles(),
+		Archive:       string(job.Archive),
+		LinkLarge:     job.LinkLarge,
+		UploadedFiles: job.uploadedFiles(),
+		ProgressMsgID: job.ProgressMsgID,
+		State:         status.String(),
+	}
+	if err := b.DB.SaveJob(record); err != nil {
+		b.Logger.LogError("Failed to persist job %d: %v", job.ID, err)
+	}
+}
+
+// ResumeJobs re-adds the jobs stored before the last shutdown and queues them again.
+// Data already on disk is picked up by the engine, so only missing pieces are downloaded
+func (b *Bot) ResumeJobs() {
+	records, err := b.DB.ListJobs()
+	if err != nil {
+		b.Logger.LogError("Failed to load stored jobs: %v", err)
+		return
+	}
+
+	for _, record := range records {
+		b.resumeJob(record)
+	}
+	if len(records) > 0 {
+		b.Logger.LogInfo("Resumed %d jobs", len(records))
+	}
+}
+
+func (b *Bot) resumeJob(record server.JobRecord) {
+	job := &Job{
+		ID:            record.ID,
+		ChatID:        record.ChatID,
+		UserID:        record.UserID,
+		MagnetLink:    record.MagnetLink,
+		Downloader:    server.NewDownloader(b.Engine, b.Logger),
+		ProgressMsgID: record.ProgressMsgID,
+		Archive:       server.ArchiveFormat(record.Archive),
+		LinkLarge:     record.LinkLarge,
+		status:        JobFetching,
+		name:          record.Name,
+	}
+	if job.UserID == 0 {
+		// stored before quotas, private chats have the user's ID
+		job.UserID = record.ChatID
+	}
+	for _, id := range record.UploadedFiles {
+		job.markUploaded(id)
+	}
+	files, err := job.Downloader.GetTorrentInfoFromFile(bytes.NewReader(record.Metainfo))
+	if err == nil {
+		err = job.Downloader.SelectFiles(record.SelectedFiles)
+	}
+	if err != nil {
+		b.Logger.LogError("Failed to resume job %d (%s): %v", record.ID, record.InfoHash, err)
+		job.Downloader.Close()
+		job.setStatus(JobFailed)
+		b.persistJob(job)
+
+		updateMsg := tgbotapi.NewEditMessageText(job.ChatID, job.ProgressMsgID,
+			jobHeader(job)+fmt.Sprintf("Could not be resumed after restart: %v", err))
+		b.Sender.Send(updateMsg)
+		return
+	}
+
+	job.Files = files
+	b.Jobs.Restore(job)
+	b.Logger.LogInfo("Resuming job %d (%s) for chat %d", job.ID, job.Name(), job.ChatID)
+
+	text := "Resumed after restart."
+	if position := b.Jobs.Enqueue(job); position > 0 {
+		text += fmt.Sprintf("\nWaiting for a free download slot (position %d in queue).", position)
+	}
+	updateMsg := tgbotapi.NewEditMessageText(job.ChatID, job.ProgressMsgID, jobHeader(job)+text)
+	b.Sender.Send(updateMsg)
+}
@@ -0,0 +1,273 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// quotaLimits are the names /setquota takes
+var quotaLimits = []string{"storage", "daily", "monthly", "jobs"}
+
+// usageSaveInterval is how often the bytes a running job downloaded are
+// added to the stored usage, rather than on every progress update
+const usageSaveInterval = 30 * time.Second
+
+// quotaOf returns the quota of a user: their own if an admin set one,
+// none for admins and the configured default for everyone else
+func (b *Bot) quotaOf(userID int64) server.Quota {
+	quota, found, err := b.DB.UserQuota(userID)
+	if err != nil {
+		b.Logger.LogError("Failed to load quota of user %d: %v", userID, err)
+	}
+	if found {
+		return quota
+	}
+	if role, _ := b.Access.Role(userID, userID); role == RoleAdmin {
+		return server.Quota{}
+	}
+
+	cfg := b.Config.AppConfig
+	return server.Quota{
+		StorageBytes: cfg.QuotaStorage,
+		DailyBytes:   cfg.QuotaDaily,
+		MonthlyBytes: cfg.QuotaMonthly,
+		Jobs:         cfg.QuotaJobs,
+	}
+}
+
+// checkJobQuota refuses a new job when the user already has as many
+// unfinished jobs as allowed. replaced is a job the new one cancels, or nil
+func (b *Bot) checkJobQuota(userID int64, replaced *Job) error {
+	quota := b.quotaOf(userID)
+	if quota.Jobs == 0 {
+		return nil
+	}
+
+	active := 0
+	for _, job := range b.Jobs.UserActiveJobs(userID) {
+		if job != replaced {
+			active++
+		}
+	}
+	if active >= quota.Jobs {
+		return fmt.Errorf("you already have %d unfinished jobs, the limit is %d. Wait for one to finish or /cancel one", active, quota.Jobs)
+	}
+	return nil
+}
+
+// checkSizeQuota refuses a selection of size bytes that would not fit the
+// user's storage, daily or monthly limit. Bytes the user's other jobs still
+// have to download are counted as used
+func (b *Bot) checkSizeQuota(job *Job, size int64) error {
+	quota := b.quotaOf(job.UserID)
+	if quota.StorageBytes == 0 && quota.DailyBytes == 0 && quota.MonthlyBytes == 0 {
+		return nil
+	}
+
+	usage, err := b.DB.Usage(job.UserID)
+	if err != nil {
+		b.Logger.LogError("Failed to load usage of user %d: %v", job.UserID, err)
+		return fmt.Errorf("could not check your quota, please try again later")
+	}
+
+	var pending int64
+	for _, other := range b.Jobs.UserActiveJobs(job.UserID) {
+		if other != job && other.Status() >= JobQueued {
+			pending += other.remainingBytes()
+		}
+	}
+	need := size + pending
+
+	switch {
+	case quota.StorageBytes > 0 && usage.StoredBytes+need > quota.StorageBytes:
+		return quotaError("storage", size, usage.StoredBytes, pending, quota.StorageBytes)
+	case quota.DailyBytes > 0 && usage.DayBytes+need > quota.DailyBytes:
+		return quotaError("daily", size, usage.DayBytes, pending, quota.DailyBytes)
+	case quota.MonthlyBytes > 0 && usage.MonthBytes+need > quota.MonthlyBytes:
+		return quotaError("monthly", size, usage.MonthBytes, pending, quota.MonthlyBytes)
+	}
+	return nil
+}
+
+func quotaError(limit string, size, used, pending, quota int64) error {
+	free := quota - used - pending
+	if free < 0 {
+		free = 0
+	}
+	return fmt.Errorf("%s is over your %s limit: %s of %s left", server.FormatBytes(size), limit,
+		server.FormatBytes(free), server.FormatBytes(quota))
+}
+
+// chargeDownload counts downloaded bytes of a job towards its user's usage
+// and reports an error once a limit is exceeded. The usage is saved every
+// usageSaveInterval and by saveUsage when the download ends
+func (b *Bot) chargeDownload(job *Job, downloaded int64) error {
+	job.mu.Lock()
+	job.charged += downloaded
+	job.unsaved += downloaded
+	save := time.Since(job.savedAt) >= usageSaveInterval
+	job.mu.Unlock()
+
+	if save {
+		b.saveUsage(job)
+	}
+	usage, err := b.DB.Usage(job.UserID)
+	if err != nil {
+		b.Logger.LogError("Failed to load usage of user %d: %v", job.UserID, err)
+		return nil
+	}
+	job.mu.Lock()
+	usage.StoredBytes += job.unsaved
+	usage.DayBytes += job.unsaved
+	usage.MonthBytes += job.unsaved
+	job.mu.Unlock()
+
+	quota := b.quotaOf(job.UserID)
+	switch {
+	case quota.StorageBytes > 0 && usage.StoredBytes > quota.StorageBytes:
+		return fmt.Errorf("storage limit of %s reached", server.FormatBytes(quota.StorageBytes))
+	case quota.DailyBytes > 0 && usage.DayBytes > quota.DailyBytes:
+		return fmt.Errorf("daily limit of %s reached", server.FormatBytes(quota.DailyBytes))
+	case quota.MonthlyBytes > 0 && usage.MonthBytes > quota.MonthlyBytes:
+		return fmt.Errorf("monthly limit of %s reached", server.FormatBytes(quota.MonthlyBytes))
+	}
+	return nil
+}
+
+// saveUsage adds what a job downloaded since the last save to its user's usage
+func (b *Bot) saveUsage(job *Job) {
+	job.mu.Lock()
+	unsaved := job.unsaved
+	job.unsaved = 0
+	job.savedAt = time.Now()
+	job.mu.Unlock()
+
+	if unsaved == 0 {
+		return
+	}
+	if _, err := b.DB.AddUsage(job.UserID, unsaved, unsaved); err != nil {
+		b.Logger.LogError("Failed to record usage of user %d: %v", job.UserID, err)
+	}
+}
+
+// remainingBytes is how much of the selection has not been counted towards the quota yet
+func (j *Job) remainingBytes() int64 {
+	if j.Downloader == nil {
+		return 0
+	}
+	size := sumSizes(j.Files, j.Downloader.SelectedFiles())
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.charged >= size {
+		return 0
+	}
+	return size - j.charged
+}
+
+// showQuota handles /quota, admins can look up someone else with /quota <id>
+func (b *Bot) showQuota(message *tgbotapi.Message) string {
+	userID := message.From.ID
+	title := "Your quota"
+
+	if arg := strings.TrimSpace(message.CommandArguments()); arg != "" {
+		if role, _ := b.Access.Role(message.From.ID, message.Chat.ID); role != RoleAdmin {
+			return "Only admins can look up the quota of other users."
+		}
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return "Usage: /quota [user id]"
+		}
+		userID = id
+		title = fmt.Sprintf("Quota of %d", id)
+	}
+
+	quota := b.quotaOf(userID)
+	usage, err := b.DB.Usage(userID)
+	if err != nil {
+		return fmt.Sprintf("Could not load the quota: %v", err)
+	}
+
+	jobs := "unlimited"
+	if quota.Jobs > 0 {
+		jobs = strconv.Itoa(quota.Jobs)
+	}
+	return fmt.Sprintf("%s:\nStorage: %s\nToday: %s\nThis month: %s\nUnfinished jobs: %d of %s",
+		title,
+		formatQuota(usage.StoredBytes, quota.StorageBytes),
+		formatQuota(usage.DayBytes, quota.DailyBytes),
+		formatQuota(usage.MonthBytes, quota.MonthlyBytes),
+		len(b.Jobs.UserActiveJobs(userID)), jobs)
+}
+
+func formatQuota(used, limit int64) string {
+	if limit == 0 {
+		return server.FormatBytes(used) + " (unlimited)"
+	}
+	return fmt.Sprintf("%s of %s", server.FormatBytes(used), server.FormatBytes(limit))
+}
+
+// setQuota handles /setquota <id> <limit> <value|unlimited|default>
+func (b *Bot) setQuota(message *tgbotapi.Message) string {
+	const usage = "Usage: /setquota <user id> <storage|daily|monthly|jobs> <size or count|unlimited>\n" +
+		"or /setquota <user id> default"
+
+	fields := strings.Fields(message.CommandArguments())
+	if len(fields) < 2 {
+		return usage
+	}
+	userID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return usage
+	}
+
+	if len(fields) == 2 && strings.EqualFold(fields[1], "default") {
+		if err := b.DB.SetUserQuota(userID, nil); err != nil {
+			return fmt.Sprintf("Could not reset the quota: %v", err)
+		}
+		b.Logger.LogInfo("User %d reset the quota of %d", message.From.ID, userID)
+		return fmt.Sprintf("%d now has the default quota.", userID)
+	}
+	if len(fields) != 3 {
+		return usage
+	}
+
+	// changing one limit starts from what the user has now
+	quota := b.quotaOf(userID)
+	limit, value := strings.ToLower(fields[1]), strings.ToLower(fields[2])
+	var amount int64
+	if value != "unlimited" {
+		if limit == "jobs" {
+			amount, err = strconv.ParseInt(value, 10, 64)
+		} else {
+			amount, err = parseSize(value)
+		}
+		if err != nil || amount <= 0 {
+			return usage
+		}
+	}
+
+	switch limit {
+	case "storage":
+		quota.StorageBytes = amount
+	case "daily":
+		quota.DailyBytes = amount
+	case "monthly":
+		quota.MonthlyBytes = amount
+	case "jobs":
+		quota.Jobs = int(amount)
+	default:
+		return fmt.Sprintf("Unknown limit %q, use %s.", fields[1], strings.Join(quotaLimits, ", "))
+	}
+
+	if err := b.DB.SetUserQuota(userID, &quota); err != nil {
+		return fmt.Sprintf("Could not set the quota: %v", err)
+	}
+	b.Logger.LogInfo("User %d set the %s quota of %d to %s", message.From.ID, limit, userID, value)
+	return fmt.Sprintf("The %s limit of %d is now %s.", limit, userID, value)
+}
@@ -0,0 +1,233 @@
+package bot
+
+import (
+	"sync"
+	"time"
+)
+
+// Telegram allows about one message per second in a private chat and
+// 20 per minute in a group, see https://core.telegram.org/bots/faq
+const (
+	privateChatInterval = 1 * time.Second
+	groupChatInterval   = 3 * time.Second
+)
+
+// sendPriority orders requests waiting for the rate limiter
+type sendPriority int
+
+const (
+	priorityProgress sendPriority = iota // progress edits, coalesced per message
+	priorityReply                        // replies to users, uploads and everything else
+)
+
+// editKey identifies the message a progress edit replaces
+type editKey struct {
+	chatID    int64
+	messageID int
+}
+
+// sendTicket is one request waiting for its turn. grant receives true when
+// it may be sent and false when a newer edit of the same message replaced it
+type sendTicket struct {
+	chatID int64
+	edit   editKey
+	grant  chan bool
+}
+
+// rateLimiter hands out turns to send so the bot stays under Telegram's
+// global and per-chat limits. Replies go before progress edits, and a
+// progress edit waiting for its turn is replaced by a newer edit of the same message
+type rateLimiter struct {
+	interval time.Duration // between any two requests
+
+	mu       sync.Mutex
+	replies  []*sendTicket
+	progress []*sendTicket
+	last     time.Time
+	held     time.Time           // no request at all is sent before, see hold
+	chats    map[int64]time.Time // when each chat may get its next request
+	wake     chan struct{}
+	done     chan struct{} // closed by close, run returns and waits are refused
+	once     sync.Once
+}
+
+// newRateLimiter starts a limiter allowing perSecond requests in total
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		perSecond = 1
+	}
+	l := &rateLimiter{
+		interval: time.Second / time.Duration(perSecond),
+		chats:    make(map[int64]time.Time),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// wait blocks until a request to chatID may be sent. chatID 0 is only held
+// to the global rate. It returns errSuperseded if a newer progress edit took
+// over and errSenderStopped once the limiter is closed
+func (l *rateLimiter) wait(chatID int64, priority sendPriority, edit editKey) error {
+	ticket := &sendTicket{chatID: chatID, edit: edit, grant: make(chan bool, 1)}
+
+	l.mu.Lock()
+	if priority == priorityProgress {
+		l.coalesce(ticket)
+	} else {
+		l.replies = append(l.replies, ticket)
+	}
+	l.mu.Unlock()
+
+	l.notify()
+	select {
+	case granted := <-ticket.grant:
+		if !granted {
+			return errSuperseded
+		}
+		return nil
+	case <-l.done:
+		return errSenderStopped
+	}
+}
+
+// close stops the limiter, requests waiting for their turn are refused
+func (l *rateLimiter) close() {
+	l.once.Do(func() { close(l.done) })
+}
+
+// hold stops every request to chatID and every request in total for d,
+// after Telegram answered a request with retry_after. Chat 0 holds only the total
+func (l *rateLimiter) hold(chatID int64, d time.Duration) {
+	l.mu.Lock()
+	until := time.Now().Add(d)
+	if chatID != 0 && until.After(l.chats[chatID]) {
+		l.chats[chatID] = until
+	}
+	if until.After(l.held) {
+		l.held = until
+	}
+	l.mu.Unlock()
+
+	l.notify()
+}
+
+// notify makes run look at the queues again
+func (l *rateLimiter) notify() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// coalesce queues a progress edit, taking the place of an older edit of the
+// same message so it keeps that edit's position. Caller holds the lock
+func (l *rateLimiter) coalesce(ticket *sendTicket) {
+	for i, queued := range l.progress {
+		if queued.edit == ticket.edit {
+			queued.grant <- false
+			l.progress[i] = ticket
+			return
+		}
+	}
+	l.progress = append(l.progress, ticket)
+}
+
+// drop releases a waiting progress edit of the message without sending it
+func (l *rateLimiter) drop(edit editKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, queued := range l.progress {
+		if queued.edit == edit {
+			queued.grant <- false
+			l.progress = append(l.progress[:i], l.progress[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *rateLimiter) run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		next := l.dispatch()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+
+		select {
+		case <-timer.C:
+		case <-l.wake:
+		case <-l.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// dispatch grants every turn that is due and returns how long to sleep until the next one
+func (l *rateLimiter) dispatch() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		now := time.Now()
+		due := l.last.Add(l.interval)
+		if l.held.After(due) {
+			due = l.held
+		}
+		if wait := due.Sub(now); wait > 0 {
+			return wait
+		}
+
+		ticket, wait := l.next(now)
+		if ticket == nil {
+			return wait
+		}
+
+		l.last = now
+		if ticket.chatID != 0 {
+			l.chats[ticket.chatID] = now.Add(chatInterval(ticket.chatID))
+		}
+		ticket.grant <- true
+	}
+}
+
+// next removes and returns the first ticket whose chat is ready, replies
+// first. Without one it returns how long until a chat becomes ready
+func (l *rateLimiter) next(now time.Time) (*sendTicket, time.Duration) {
+	wait := time.Hour
+	for _, queue := range []*[]*sendTicket{&l.replies, &l.progress} {
+		for i, ticket := range *queue {
+			ready := l.chats[ticket.chatID]
+			if ticket.chatID == 0 || !ready.After(now) {
+				*queue = append((*queue)[:i], (*queue)[i+1:]...)
+				return ticket, 0
+			}
+			if d := ready.Sub(now); d < wait {
+				wait = d
+			}
+		}
+	}
+
+	// forget chats that have been quiet long enough
+	for chatID, ready := range l.chats {
+		if ready.Before(now) {
+			delete(l.chats, chatID)
+		}
+	}
+	return nil, wait
+}
+
+// chatInterval is the time between two messages to a chat, group IDs are negative
+func chatInterval(chatID int64) time.Duration {
+	if chatID < 0 {
+		return groupChatInterval
+	}
+	return privateChatInterval
+}
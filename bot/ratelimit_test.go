@@ -0,0 +1,169 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestRateLimiterHold(t *testing.T) {
+	l := newRateLimiter(1000)
+	l.wait(5, priorityReply, editKey{})
+
+	// a 429 in chat 5 holds that chat and every other one
+	const hold = 300 * time.Millisecond
+	start := time.Now()
+	l.hold(5, hold)
+
+	done := make(chan int64, 2)
+	for _, chatID := range []int64{5, 6} {
+		go func() {
+			l.wait(chatID, priorityReply, editKey{})
+			done <- chatID
+		}()
+	}
+	for range 2 {
+		chatID := <-done
+		if elapsed := time.Since(start); elapsed < hold-10*time.Millisecond {
+			t.Errorf("chat %d was sent to after %s, during the hold", chatID, elapsed)
+		}
+	}
+}
+
+func TestRateLimiterClose(t *testing.T) {
+	l := newRateLimiter(1000)
+	l.wait(5, priorityReply, editKey{})
+
+	// chat 5 is not ready for another second
+	done := make(chan error)
+	go func() { done <- l.wait(5, priorityReply, editKey{}) }()
+	l.close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errSenderStopped) {
+			t.Errorf("wait after close = %v, want %v", err, errSenderStopped)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("wait still blocked after close")
+	}
+}
+
+// fakeAPI answers Bot API calls and records the text of every message edit.
+// Edits with the text in block wait until release is closed
+type fakeAPI struct {
+	block   string
+	release chan struct{}
+
+	mu    sync.Mutex
+	edits []string
+}
+
+func (f *fakeAPI) Do(req *http.Request) (*http.Response, error) {
+	result := `{"id":1,"is_bot":true,"first_name":"bot","username":"bot"}`
+	if strings.HasSuffix(req.URL.Path, "/editMessageText") {
+		if err := req.ParseForm(); err != nil {
+			return nil, err
+		}
+		text := req.PostForm.Get("text")
+		if text == f.block {
+			<-f.release
+		}
+		f.mu.Lock()
+		f.edits = append(f.edits, text)
+		f.mu.Unlock()
+		result = `{"message_id":2,"chat":{"id":1},"date":0,"text":"` + text + `"}`
+	}
+	body := `{"ok":true,"result":` + result + `}`
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestSendAfterProgress(t *testing.T) {
+	fake := &fakeAPI{block: "10%", release: make(chan struct{})}
+	api, err := tgbotapi.NewBotAPIWithClient("token", tgbotapi.APIEndpoint, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := server.NewLogger(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	s := NewSender(api, 1000, logger, stop)
+	defer s.Close()
+
+	// 10% is being sent when 20% comes in and the download finishes
+	s.SendProgress(tgbotapi.NewEditMessageText(1, 2, "10%"))
+	time.Sleep(100 * time.Millisecond)
+	s.SendProgress(tgbotapi.NewEditMessageText(1, 2, "20%"))
+
+	sent := make(chan error)
+	go func() {
+		_, err := s.Send(tgbotapi.NewEditMessageText(1, 2, "Done"))
+		sent <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(fake.release)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if want := []string{"10%", "Done"}; !slices.Equal(fake.edits, want) {
+		t.Errorf("edits = %q, want %q", fake.edits, want)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	flood := &tgbotapi.Error{Code: 429, Message: "Too Many Requests", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 7}}
+	reset := &url.Error{Op: "Post", URL: "https://api.telegram.org", Err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}}
+	refused := &url.Error{Op: "Post", URL: "https://api.telegram.org", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	dns := &url.Error{Op: "Post", URL: "https://api.telegram.org", Err: &net.DNSError{Err: "no such host", Name: "api.telegram.org"}}
+
+	tests := []struct {
+		name       string
+		err        error
+		idempotent bool
+		wait       time.Duration
+		retry      bool
+	}{
+		{"flood", flood, false, 7 * time.Second, true},
+		{"flood too long", &tgbotapi.Error{Code: 429, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 3600}}, false, time.Hour, false},
+		{"flood without retry_after", &tgbotapi.Error{Code: 429}, false, time.Second, true},
+		{"server error", &tgbotapi.Error{Code: 502}, false, time.Second, true},
+		{"bad request", &tgbotapi.Error{Code: 400}, true, 0, false},
+		{"reset sending a message", reset, false, time.Second, false},
+		{"reset editing a message", reset, true, time.Second, true},
+		{"connection refused", refused, false, time.Second, true},
+		{"dns failure", dns, false, time.Second, true},
+		{"wrapped flood", fmt.Errorf("part 2 of 3: %w", flood), false, 7 * time.Second, true},
+	}
+	for _, tt := range tests {
+		wait, retry := retryDelay(tt.err, time.Second, tt.idempotent)
+		if retry != tt.retry || (retry && wait != tt.wait) {
+			t.Errorf("%s: retryDelay = %s, %v, want %s, %v", tt.name, wait, retry, tt.wait, tt.retry)
+		}
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	if idempotent(tgbotapi.NewMessage(1, "hi")) || idempotent(tgbotapi.NewDocument(1, tgbotapi.FileID("x"))) {
+		t.Error("sending a message must not count as idempotent")
+	}
+	if !idempotent(tgbotapi.NewEditMessageText(1, 2, "hi")) || !idempotent(tgbotapi.NewCallback("id", "")) {
+		t.Error("edits and callback answers are idempotent")
+	}
+}
@@ -0,0 +1,319 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Selection grammar for typed file selections. Terms are separated by commas or spaces:
+//
+//	all            every file
+//	3, 1-10        file numbers and inclusive ranges as shown in the list
+//	*.mkv, S01/*   globs, matched against the file name and its path in the torrent
+//	video, subs    extension groups, see selectionGroups
+//	>100MB, <=1GB  size filters, every filter must hold
+//	!*.nfo, -3     exclusions, any term prefixed with ! or -
+//
+// Numbers, ranges, globs and groups add files. Without any of them the
+// selection starts from all files, so "!*.nfo" and ">100MB" work on their own.
+// Size filters then narrow the result and exclusions remove from it.
+
+// selectionGroups maps group names to the extensions they match
+var selectionGroups = map[string][]string{
+	"video":    {".mkv", ".mp4", ".avi", ".mov", ".wmv", ".flv", ".webm", ".m4v", ".mpg", ".mpeg", ".ts"},
+	"audio":    {".mp3", ".flac", ".aac", ".ogg", ".wav", ".m4a", ".opus", ".wma"},
+	"subs":     {".srt", ".ass", ".ssa", ".sub", ".idx", ".vtt"},
+	"images":   {".jpg", ".jpeg", ".png", ".gif", ".bmp", ".webp"},
+	"docs":     {".pdf", ".epub", ".txt", ".nfo", ".doc", ".docx"},
+	"archives": {".zip", ".rar", ".7z", ".tar", ".gz"},
+}
+
+// selectionAliases lets users type the singular or a common synonym of a group
+var selectionAliases = map[string]string{
+	"videos":    "video",
+	"music":     "audio",
+	"sub":       "subs",
+	"subtitles": "subs",
+	"image":     "images",
+	"pictures":  "images",
+	"doc":       "docs",
+	"archive":   "archives",
+}
+
+// Size units accepted by size filters, powers of 1024 like server.FormatBytes
+var selectionUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+	"t":  1 << 40,
+	"tb": 1 << 40,
+}
+
+// errEmptySelection is returned when a selection is valid but matches nothing
+var errEmptySelection = errors.New("selection matches no files")
+
+// fileMatcher reports whether the file at index id is matched by a term
+type fileMatcher func(id int, file server.TorrentFile) bool
+
+// ParseSelection evaluates a selection expression against files and returns
+// the sorted IDs of the selected files
+func ParseSelection(expr string, files []server.TorrentFile) ([]int, error) {
+	terms := tokenizeSelection(expr)
+	if len(terms) == 0 {
+		return nil, errors.New("empty selection")
+	}
+
+	var includes, filters, excludes []fileMatcher
+	for _, term := range terms {
+		exclude := false
+		if strings.HasPrefix(term, "!") || strings.HasPrefix(term, "-") {
+			exclude = true
+			term = term[1:]
+		}
+
+		matcher, isFilter, err := parseSelectionTerm(term, len(files))
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case exclude:
+			excludes = append(excludes, matcher)
+		case isFilter:
+			filters = append(filters, matcher)
+		default:
+			includes = append(includes, matcher)
+		}
+	}
+
+	if len(includes) == 0 {
+		includes = append(includes, func(int, server.TorrentFile) bool { return true })
+	}
+
+	var selected []int
+	for id, file := range files {
+		if matchesAny(includes, id, file) && matchesAll(filters, id, file) && !matchesAny(excludes, id, file) {
+			selected = append(selected, id)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, errEmptySelection
+	}
+	sort.Ints(selected)
+	return selected, nil
+}
+
+// tokenizeSelection splits on commas and spaces, re-attaching operators and
+// units typed with a space such as "> 100 MB" or "! *.nfo". A dash between two
+// numbers is a range however it is spaced, "1 - 3" is not 1 without 3
+func tokenizeSelection(expr string) []string {
+	var terms []string
+	for _, group := range strings.Split(expr, ",") {
+		fields := strings.Fields(group)
+		start := len(terms) // ranges do not reach across commas
+		for i := 0; i < len(fields); i++ {
+			field := fields[i]
+			if len(terms) > start {
+				last := terms[len(terms)-1]
+				switch {
+				case isDigits(last) && field == "-" && i+1 < len(fields) && isDigits(fields[i+1]):
+					i++
+					terms[len(terms)-1] = last + "-" + fields[i]
+					continue
+				case isDigits(last) && strings.HasPrefix(field, "-") && isDigits(field[1:]),
+					strings.HasSuffix(last, "-") && isDigits(last[:len(last)-1]) && isDigits(field):
+					terms[len(terms)-1] = last + field
+					continue
+				}
+			}
+
+			for isSelectionOperator(field) && i+1 < len(fields) {
+				i++
+				field += fields[i]
+			}
+
+			// "100 MB" belongs to the size filter before it
+			if unit := strings.ToLower(field); unit != "" && len(terms) > 0 {
+				last := terms[len(terms)-1]
+				if _, ok := selectionUnits[unit]; ok && strings.ContainsAny(last, "<>") && isDigits(last[len(last)-1:]) {
+					terms[len(terms)-1] += field
+					continue
+				}
+			}
+			terms = append(terms, field)
+		}
+	}
+	return terms
+}
+
+func isSelectionOperator(s string) bool {
+	switch s {
+	case "!", "-", ">", "<", ">=", "<=", "!>", "!<", "->", "-<":
+		return true
+	}
+	return false
+}
+
+// parseSelectionTerm builds the matcher of a single term without its exclusion prefix.
+// isFilter is set for size filters which narrow the selection instead of adding to it
+func parseSelectionTerm(term string, fileCount int) (matcher fileMatcher, isFilter bool, err error) {
+	lower := strings.ToLower(term)
+
+	switch {
+	case term == "":
+		return nil, false, errors.New("missing term after exclusion")
+
+	case lower == "all":
+		return func(int, server.TorrentFile) bool { return true }, false, nil
+
+	case strings.HasPrefix(term, ">") || strings.HasPrefix(term, "<"):
+		matcher, err := parseSizeFilter(lower)
+		return matcher, true, err
+
+	case strings.ContainsAny(term, "*?["):
+		if _, err := path.Match(term, ""); err != nil {
+			return nil, false, fmt.Errorf("invalid pattern %q", term)
+		}
+		return func(_ int, file server.TorrentFile) bool {
+			if ok, _ := path.Match(term, file.Name); ok {
+				return true
+			}
+			ok, _ := path.Match(term, path.Base(file.Name))
+			return ok
+		}, false, nil
+
+	case isDigits(strings.Replace(term, "-", "", 1)):
+		first, last, err := parseSelectionRange(term, fileCount)
+		if err != nil {
+			return nil, false, err
+		}
+		return func(id int, _ server.TorrentFile) bool {
+			return id+1 >= first && id+1 <= last
+		}, false, nil
+	}
+
+	group := lower
+	if alias, ok := selectionAliases[group]; ok {
+		group = alias
+	}
+	extensions, ok := selectionGroups[group]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown selection term %q", term)
+	}
+	return func(_ int, file server.TorrentFile) bool {
+		ext := strings.ToLower(path.Ext(file.Name))
+		for _, candidate := range extensions {
+			if ext == candidate {
+				return true
+			}
+		}
+		return false
+	}, false, nil
+}
+
+// parseSelectionRange parses "N" or "N-M" as 1-based file numbers
+func parseSelectionRange(term string, fileCount int) (first, last int, err error) {
+	bounds := strings.SplitN(term, "-", 2)
+	if first, err = strconv.Atoi(bounds[0]); err != nil {
+		return 0, 0, fmt.Errorf("invalid file number %q", term)
+	}
+	last = first
+	if len(bounds) == 2 {
+		if last, err = strconv.Atoi(bounds[1]); err != nil {
+			return 0, 0, fmt.Errorf("invalid range %q", term)
+		}
+	}
+
+	if first > last {
+		return 0, 0, fmt.Errorf("invalid range %q: start is after end", term)
+	}
+	if first < 1 || last > fileCount {
+		return 0, 0, fmt.Errorf("file number out of range in %q: please use numbers between 1 and %d", term, fileCount)
+	}
+	return first, last, nil
+}
+
+// parseSizeFilter parses ">100MB", "<=1.5GB" and similar
+func parseSizeFilter(term string) (fileMatcher, error) {
+	op := term[:1]
+	if strings.HasPrefix(term[1:], "=") {
+		op = term[:2]
+	}
+	limit, err := parseSize(term[len(op):])
+	if err != nil {
+		return nil, fmt.Errorf("invalid size %q, use e.g. >100MB or <1.5GB", term)
+	}
+
+	return func(_ int, file server.TorrentFile) bool {
+		switch op {
+		case ">":
+			return file.Size > limit
+		case ">=":
+			return file.Size >= limit
+		case "<":
+			return file.Size < limit
+		default:
+			return file.Size <= limit
+		}
+	}, nil
+}
+
+// parseSize parses sizes such as "100MB", "1.5gb" or "512"
+func parseSize(value string) (int64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	split := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	number, unit := value, ""
+	if split >= 0 {
+		number, unit = value[:split], strings.TrimSpace(value[split:])
+	}
+
+	amount, err := strconv.ParseFloat(number, 64)
+	multiplier, ok := selectionUnits[unit]
+	if err != nil || !ok || amount < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(amount * float64(multiplier)), nil
+}
+
+func matchesAny(matchers []fileMatcher, id int, file server.TorrentFile) bool {
+	for _, match := range matchers {
+		if match(id, file) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAll(matchers []fileMatcher, id int, file server.TorrentFile) bool {
+	for _, match := range matchers {
+		if !match(id, file) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// selectionFiles is a small season pack, file numbers in comments are as shown to users
+var selectionFiles = []server.TorrentFile{
+	{Name: "Show/S01/E01.mkv", Size: 700 << 20},  // 1
+	{Name: "Show/S01/E01.srt", Size: 40 << 10},   // 2
+	{Name: "Show/S01/E02.mkv", Size: 1200 << 20}, // 3
+	{Name: "Show/S01/E02.srt", Size: 38 << 10},   // 4
+	{Name: "Show/S02/E01.mp4", Size: 2 << 30},    // 5
+	{Name: "Show/info.nfo", Size: 2 << 10},       // 6
+	{Name: "Show/cover.JPG", Size: 300 << 10},    // 7
+	{Name: "Show/OST/01.flac", Size: 30 << 20},   // 8
+}
+
+func TestParseSelection(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []int
+	}{
+		// numbers and ranges, 1-based in the expression and 0-based in the result
+		{"3", []int{2}},
+		{"1,3", []int{0, 2}},
+		{"1 3", []int{0, 2}},
+		{"1-3", []int{0, 1, 2}},
+		{"2-2", []int{1}},
+		{"7-8, 1", []int{0, 6, 7}},
+		{"1 - 3", []int{0, 1, 2}},
+		{"1 -3", []int{0, 1, 2}},
+		{"1- 3", []int{0, 1, 2}},
+		{"5 - 6 8", []int{4, 5, 7}},
+		{"all", []int{0, 1, 2, 3, 4, 5, 6, 7}},
+		{"ALL", []int{0, 1, 2, 3, 4, 5, 6, 7}},
+
+		// globs match the base name or the path in the torrent
+		{"*.mkv", []int{0, 2}},
+		{"Show/S01/*", []int{0, 1, 2, 3}},
+		{"E0?.srt", []int{1, 3}},
+		{"*.[ms][kr][vt]", []int{0, 1, 2, 3}},
+
+		// groups, aliases and case-insensitive extensions
+		{"video", []int{0, 2, 4}},
+		{"videos", []int{0, 2, 4}},
+		{"subs", []int{1, 3}},
+		{"subtitles", []int{1, 3}},
+		{"images", []int{6}},
+		{"music", []int{7}},
+		{"video subs", []int{0, 1, 2, 3, 4}},
+
+		// size filters narrow what the other terms add
+		{">100MB", []int{0, 2, 4}},
+		{">1gb", []int{2, 4}},
+		{">=2GB", []int{4}},
+		{"<1MB", []int{1, 3, 5, 6}},
+		{"<=40KB", []int{1, 3, 5}},
+		{"video <1.5GB", []int{0, 2}},
+		{">1MB <1GB", []int{0, 7}},
+		{"> 100 MB", []int{0, 2, 4}},
+		{">100 MB", []int{0, 2, 4}},
+		{"video, < 1 GB", []int{0}},
+
+		// exclusions
+		{"all -3", []int{0, 1, 3, 4, 5, 6, 7}},
+		{"all !3", []int{0, 1, 3, 4, 5, 6, 7}},
+		{"!*.nfo", []int{0, 1, 2, 3, 4, 6, 7}},
+		{"! *.nfo", []int{0, 1, 2, 3, 4, 6, 7}},
+		{"-subs", []int{0, 2, 4, 5, 6, 7}},
+		{"1-4 -2-3", []int{0, 3}},
+		{"1, -3", []int{0}},
+		{"1-4 - 2", []int{0, 2, 3}},
+		{"video !Show/S02/*", []int{0, 2}},
+		{"video !S02/*", []int{0, 2, 4}}, // a glob with a slash must match the whole path
+		{"!<1MB", []int{0, 2, 4, 7}},
+		{"Show/S01/* -subs", []int{0, 2}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSelection(tt.expr, selectionFiles)
+		if err != nil {
+			t.Errorf("ParseSelection(%q) error: %v", tt.expr, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParseSelection(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseSelectionErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string // part of the error message
+	}{
+		{"", "empty selection"},
+		{" , ", "empty selection"},
+		{"0", "out of range"},
+		{"9", "out of range"},
+		{"2-9", "out of range"},
+		{"5-3", "start is after end"},
+		{"1-", "invalid range"},
+		{"1-2-3", "unknown selection term"},
+		{"banana", "unknown selection term"},
+		{"!", "missing term after exclusion"},
+		{"[", "invalid pattern"},
+		{">", "invalid size"},
+		{">abc", "invalid size"},
+		{">10XB", "invalid size"},
+		{"<-5MB", "invalid size"},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSelection(tt.expr, selectionFiles)
+		if err == nil {
+			t.Errorf("ParseSelection(%q) = %v, want an error", tt.expr, got)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParseSelection(%q) error %q, want it to mention %q", tt.expr, err, tt.want)
+		}
+	}
+}
+
+func TestParseSelectionMatchesNothing(t *testing.T) {
+	for _, expr := range []string{"*.iso", "all -1-8", ">10GB", "docs !*.nfo"} {
+		if _, err := ParseSelection(expr, selectionFiles); !errors.Is(err, errEmptySelection) {
+			t.Errorf("ParseSelection(%q) error %v, want errEmptySelection", expr, err)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"512", 512},
+		{"1k", 1 << 10},
+		{"100MB", 100 << 20},
+		{"1.5gb", 3 << 29},
+		{" 2 GB ", 2 << 30},
+		{"1T", 1 << 40},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "MB", "1.2.3", "-1", "5 parsecs"} {
+		if got, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", in, got)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Retry limits of the Sender
+const (
+	sendAttempts     = 5
+	sendBackoff      = 1 * time.Second
+	sendMaxBackoff   = 30 * time.Second
+	sendMaxRetryWait = 5 * time.Minute // longest retry_after honoured before giving up
+)
+
+// errSenderStopped is returned instead of waiting for a retry during shutdown
+var errSenderStopped = errors.New("sender stopped")
+
+// errSuperseded is returned for a progress edit replaced by a newer one before it was sent
+var errSuperseded = errors.New("superseded by a newer edit")
+
+// Sender makes Bot API calls, waiting out flood limits (429 with retry_after)
+// and retrying network and 5xx errors with exponential backoff. A flood limit
+// holds back the other requests too, and messages are not sent again after
+// network errors that may have delivered them. Other errors,
+// such as bad requests, are returned right away. Files must be reopenable
+// (see uploadSource) so a retried upload starts from the beginning.
+// Every attempt first waits for its turn from the rate limiter
+type Sender struct {
+	api     *tgbotapi.BotAPI
+	logger  *server.Logger
+	limiter *rateLimiter
+	stop    <-chan struct{}
+
+	mu       sync.Mutex
+	progress map[editKey]*progressEdits
+}
+
+// progressEdits sends the progress edits of one message, one at a time
+type progressEdits struct {
+	latest *tgbotapi.EditMessageTextConfig // next edit to send, nil when there is none
+	done   chan struct{}                   // closed when the worker returns
+}
+
+// NewSender sends through api at no more than perSecond requests in total
+func NewSender(api *tgbotapi.BotAPI, perSecond int, logger *server.Logger, stop <-chan struct{}) *Sender {
+	return &Sender{
+		api:      api,
+		logger:   logger,
+		limiter:  newRateLimiter(perSecond),
+		stop:     stop,
+		progress: make(map[editKey]*progressEdits),
+	}
+}
+
+// Close stops the rate limiter. Requests made afterwards fail with errSenderStopped
+func (s *Sender) Close() {
+	s.limiter.close()
+}
+
+// Send sends a message or edit and returns the resulting message
+func (s *Sender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	// a status edit must not be overwritten by older progress
+	if edit, ok := c.(tgbotapi.EditMessageTextConfig); ok {
+		s.settleProgress(editKey{chatID: edit.ChatID, messageID: edit.MessageID})
+	}
+
+	var msg tgbotapi.Message
+	err := s.retry(chatOf(c), priorityReply, editKey{}, idempotent(c), func() (err error) {
+		msg, err = s.api.Send(c)
+		return err
+	})
+	return msg, err
+}
+
+// SendProgress edits a progress message in the background. The edit waits
+// behind replies to users and replaces an edit of the same message that was
+// not sent yet, so a slow chat only gets the latest progress. Each message
+// has one worker sending its edits in order
+func (s *Sender) SendProgress(edit tgbotapi.EditMessageTextConfig) {
+	key := editKey{chatID: edit.ChatID, messageID: edit.MessageID}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if worker, ok := s.progress[key]; ok {
+		worker.latest = &edit
+		return
+	}
+	worker := &progressEdits{latest: &edit, done: make(chan struct{})}
+	s.progress[key] = worker
+	go s.sendProgress(key, worker)
+}
+
+// sendProgress sends the latest edit of the worker's message until there is none left
+func (s *Sender) sendProgress(key editKey, worker *progressEdits) {
+	defer close(worker.done)
+	for {
+		s.mu.Lock()
+		edit := worker.latest
+		worker.latest = nil
+		if edit == nil {
+			delete(s.progress, key)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		err := s.retry(key.chatID, priorityProgress, key, true, func() error {
+			_, err := s.api.Send(*edit)
+			return err
+		})
+		if err != nil && !errors.Is(err, errSuperseded) && !errors.Is(err, errSenderStopped) {
+			s.logger.LogError("Failed to edit progress message %d in chat %d: %v", key.messageID, key.chatID, err)
+		}
+	}
+}
+
+// settleProgress discards the pending progress edits of a message and waits
+// for one already being sent, so none of them lands after the edit that follows
+func (s *Sender) settleProgress(key editKey) {
+	s.mu.Lock()
+	worker, ok := s.progress[key]
+	if ok {
+		worker.latest = nil
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	s.limiter.drop(key)
+	<-worker.done
+}
+
+// Request makes a call whose result is not a message, e.g. answering a callback
+func (s *Sender) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	var resp *tgbotapi.APIResponse
+	err := s.retry(chatOf(c), priorityReply, editKey{}, idempotent(c), func() (err error) {
+		resp, err = s.api.Request(c)
+		return err
+	})
+	return resp, err
+}
+
+// SendMediaGroup sends an album
+func (s *Sender) SendMediaGroup(config tgbotapi.MediaGroupConfig) ([]tgbotapi.Message, error) {
+	var msgs []tgbotapi.Message
+	err := s.retry(config.ChatID, priorityReply, editKey{}, false, func() (err error) {
+		msgs, err = s.api.SendMediaGroup(config)
+		return err
+	})
+	return msgs, err
+}
+
+// UploadFiles calls endpoint with params the library has no config type for
+func (s *Sender) UploadFiles(endpoint string, params tgbotapi.Params, files []tgbotapi.RequestFile) (*tgbotapi.APIResponse, error) {
+	chatID, _ := strconv.ParseInt(params["chat_id"], 10, 64)
+
+	var resp *tgbotapi.APIResponse
+	err := s.retry(chatID, priorityReply, editKey{}, false, func() (err error) {
+		resp, err = s.api.UploadFiles(endpoint, params, files)
+		return err
+	})
+	return resp, err
+}
+
+// chatOf returns the chat a request goes to, 0 for requests that are not
+// held to a chat's rate such as callback answers
+func chatOf(c tgbotapi.Chattable) int64 {
+	switch c := c.(type) {
+	case tgbotapi.MessageConfig:
+		return c.ChatID
+	case tgbotapi.EditMessageTextConfig:
+		return c.ChatID
+	case tgbotapi.DocumentConfig:
+		return c.ChatID
+	case tgbotapi.PhotoConfig:
+		return c.ChatID
+	case tgbotapi.AudioConfig:
+		return c.ChatID
+	case tgbotapi.VideoConfig:
+		return c.ChatID
+	}
+	return 0
+}
+
+// idempotent reports whether sending c twice has the same effect as once.
+// Edits and callback answers are, anything that posts a message is not
+func idempotent(c tgbotapi.Chattable) bool {
+	switch c.(type) {
+	case tgbotapi.EditMessageTextConfig, tgbotapi.EditMessageReplyMarkupConfig,
+		tgbotapi.EditMessageCaptionConfig, tgbotapi.CallbackConfig, tgbotapi.DeleteMessageConfig:
+		return true
+	}
+	return false
+}
+
+// retry runs call until it succeeds, fails permanently or runs out of attempts.
+// Each attempt waits for the rate limiter first. Calls that are not idempotent
+// are only retried when Telegram answered, or the connection was never made
+func (s *Sender) retry(chatID int64, priority sendPriority, edit editKey, idempotent bool, call func() error) error {
+	backoff := sendBackoff
+	for attempt := 1; ; attempt++ {
+		if err := s.limiter.wait(chatID, priority, edit); err != nil {
+			return err
+		}
+
+		err := call()
+		if err == nil {
+			return nil
+		}
+
+		if wait, flood := floodWait(err); flood {
+			// the rest of the chat's and the bot's requests would be refused too
+			s.limiter.hold(chatID, wait)
+		}
+
+		wait, retryable := retryDelay(err, backoff, idempotent)
+		if !retryable || attempt == sendAttempts {
+			return err
+		}
+		s.logger.LogError("Telegram request failed (attempt %d of %d), retrying in %s: %v", attempt, sendAttempts, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-s.stop:
+			return errSenderStopped
+		}
+
+		backoff *= 2
+		if backoff > sendMaxBackoff {
+			backoff = sendMaxBackoff
+		}
+	}
+}
+
+// retryDelay tells how long to wait before retrying err and whether it is worth it
+func retryDelay(err error, backoff time.Duration, idempotent bool) (time.Duration, bool) {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		// the file to upload is gone, trying again will not bring it back
+		return 0, false
+	}
+
+	var apiErr *tgbotapi.Error
+	if !errors.As(err, &apiErr) {
+		// no API response at all: connection reset, timeout, DNS... A reset or
+		// timeout may come after Telegram got the request, sending it again
+		// could post the message twice
+		return backoff, idempotent || notSent(err)
+	}
+
+	switch {
+	case apiErr.Code == http.StatusTooManyRequests:
+		wait, _ := floodWait(err)
+		if wait <= 0 {
+			wait = backoff
+		}
+		return wait, wait <= sendMaxRetryWait
+	case apiErr.Code >= 500:
+		return backoff, true
+	}
+	return 0, false
+}
+
+// floodWait returns the retry_after of a 429 answer
+func floodWait(err error) (time.Duration, bool) {
+	var apiErr *tgbotapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusTooManyRequests {
+		return 0, false
+	}
+	return time.Duration(apiErr.RetryAfter) * time.Second, true
+}
+
+// notSent reports whether err happened before a connection to Telegram was made
+func notSent(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
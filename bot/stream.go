@@ -0,0 +1,81 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// streamJob handles /stream <job id> [file number]. Without a file number it
+// lists the job's files, with one it downloads that file in order and replies
+// with a link a player can open while the rest is still coming in
+func (b *Bot) streamJob(chatID int64, args string) string {
+	if b.Links == nil {
+		return "Streaming needs the HTTP server, which is off (PUBLIC_URL is not set)."
+	}
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "Usage: /stream <job id> [file number]"
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(fields[0], "#"))
+	if err != nil {
+		return "Usage: /stream <job id> [file number]"
+	}
+
+	job, err := b.Jobs.Job(chatID, id)
+	if err != nil {
+		return fmt.Sprintf("Could not stream: %v", err)
+	}
+	if job.Status() != JobDownloading {
+		return fmt.Sprintf("%s is %s, only downloading jobs can be streamed.", job.Label(), strings.ToLower(job.Status().String()))
+	}
+
+	selected := make(map[int]bool)
+	for _, fileID := range job.Downloader.SelectedFiles() {
+		selected[fileID] = true
+	}
+	if len(fields) == 1 {
+		return streamFileList(job, selected)
+	}
+
+	number, err := strconv.Atoi(fields[1])
+	if err != nil || !selected[number-1] || number > len(job.Files) {
+		return fmt.Sprintf("No file %s in %s. Use /stream %d to list its files.", fields[1], job.Label(), job.ID)
+	}
+	file := job.Files[number-1]
+
+	path, err := job.Downloader.Stream(file.ID)
+	if err != nil {
+		b.Logger.LogError("Failed to stream %s of job #%d: %v", file.Name, job.ID, err)
+		return fmt.Sprintf("Could not stream: %v", err)
+	}
+	link, expires, err := b.Links.URL(chatID, path)
+	if err != nil {
+		b.Logger.LogError("Failed to make a stream link for %s: %v", path, err)
+		return fmt.Sprintf("Could not stream: %v", err)
+	}
+
+	return fmt.Sprintf("Streaming %s (%s)\nIts pieces are now downloaded in order. Open this link in a player, playback waits for parts not downloaded yet:\n%s\n\nThe link works until %s.",
+		file.Name, server.FormatBytes(file.Size), link, expires.Format("2006-01-02 15:04 MST"))
+}
+
+// streamFileList numbers the selected files of a job for /stream
+func streamFileList(job *Job, selected map[int]bool) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Files of %s:\n", job.Label()))
+	for i, file := range job.Files {
+		if !selected[i] {
+			continue
+		}
+		line := fmt.Sprintf("%d. %s (%s)\n", i+1, file.Name, server.FormatBytes(file.Size))
+		if sb.Len()+len(line) > summaryLength {
+			sb.WriteString("…\n")
+			break
+		}
+		sb.WriteString(line)
+	}
+	sb.WriteString(fmt.Sprintf("\nSend /stream %d <number> to stream one.", job.ID))
+	return sb.String()
+}
@@ -0,0 +1,98 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"path"
+	"sort"
+	"strings"
+)
+
+// fileTree is a directory of the torrent built from the files' relative paths
+type fileTree struct {
+	name  string
+	path  string // relative path, "" for the torrent root
+	dirs  []*fileTree
+	files []int // indexes into Job.Files directly in this directory
+	all   []int // indexes of every file below this directory
+}
+
+// treeEntry is one row of a directory listing, either a subdirectory or a file
+type treeEntry struct {
+	dir  *fileTree
+	file int
+}
+
+// buildFileTree groups files by directory, subdirectories and files sorted by name
+func buildFileTree(files []server.TorrentFile) *fileTree {
+	root := &fileTree{}
+	for i, file := range files {
+		node := root
+		node.all = append(node.all, i)
+
+		parts := strings.Split(file.Name, "/")
+		for _, part := range parts[:len(parts)-1] {
+			node = node.child(part)
+			node.all = append(node.all, i)
+		}
+		node.files = append(node.files, i)
+	}
+	root.sort(files)
+	return root
+}
+
+// child returns the subdirectory called name, creating it if needed
+func (t *fileTree) child(name string) *fileTree {
+	for _, dir := range t.dirs {
+		if dir.name == name {
+			return dir
+		}
+	}
+	dir := &fileTree{name: name, path: path.Join(t.path, name)}
+	t.dirs = append(t.dirs, dir)
+	return dir
+}
+
+func (t *fileTree) sort(files []server.TorrentFile) {
+	sort.Slice(t.dirs, func(i, j int) bool { return t.dirs[i].name < t.dirs[j].name })
+	sort.SliceStable(t.files, func(i, j int) bool {
+		return path.Base(files[t.files[i]].Name) < path.Base(files[t.files[j]].Name)
+	})
+	for _, dir := range t.dirs {
+		dir.sort(files)
+	}
+}
+
+// find returns the directory at a relative path, the root when it does not exist
+func (t *fileTree) find(dirPath string) *fileTree {
+	if dirPath == "" {
+		return t
+	}
+
+	node := t
+	for _, part := range strings.Split(dirPath, "/") {
+		var next *fileTree
+		for _, dir := range node.dirs {
+			if dir.name == part {
+				next = dir
+				break
+			}
+		}
+		if next == nil {
+			return t
+		}
+		node = next
+	}
+	return node
+}
+
+// entries lists the directory, subdirectories first
+func (t *fileTree) entries() []treeEntry {
+	entries := make([]treeEntry, 0, len(t.dirs)+len(t.files))
+	for _, dir := range t.dirs {
+		entries = append(entries, treeEntry{dir: dir})
+	}
+	for _, file := range t.files {
+		entries = append(entries, treeEntry{file: file})
+	}
+	return entries
+}
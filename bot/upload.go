@@ -0,0 +1,547 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// uploadResult is the outcome of one file, reported in the summary after the upload
+type uploadResult struct {
+	name string
+	err  error
+}
+
+// Longest upload summary, Telegram messages are limited to 4096 characters
+const summaryLength = 3800
+
+// uploadFiles uploads downloaded files to Telegram. A failed file does not
+// stop the rest, every result is listed in the summary at the end. Sent files
+// are stored with the job, so an upload resumed after a restart skips them
+func (b *Bot) uploadFiles(job *Job, files []server.TorrentFile) bool {
+	var pending []server.TorrentFile
+	for _, file := range files {
+		if !job.isUploaded(file.ID) {
+			pending = append(pending, file)
+		}
+	}
+	if skipped := len(files) - len(pending); skipped > 0 {
+		b.Logger.LogInfo("Job %d: %d files were uploaded before, sending the remaining %d", job.ID, skipped, len(pending))
+	}
+
+	var results []uploadResult
+	for _, batch := range b.uploadBatches(pending) {
+		// stop between files once the job is cancelled
+		if job.Status() == JobCancelled {
+			return false
+		}
+
+		var batchResults []uploadResult
+		if len(batch) > 1 {
+			batchResults = b.uploadAlbum(job, batch)
+		} else {
+			batchResults = []uploadResult{{name: batch[0].Name, err: b.uploadFile(job, batch[0], fileKey(job, batch[0]))}}
+		}
+
+		for i, result := range batchResults {
+			if result.err == nil {
+				job.markUploaded(batch[i].ID)
+			}
+		}
+		b.persistJob(job)
+		results = append(results, batchResults...)
+
+		// Small delay between uploads
+		time.Sleep(1 * time.Second)
+	}
+
+	b.sendUploadSummary(job, results, len(files)-len(pending))
+	return uploadSucceeded(results)
+}
+
+// uploadArchive bundles the files into one archive and uploads it, in parts when it is over the limit
+func (b *Bot) uploadArchive(job *Job, files []server.TorrentFile) bool {
+	chatID := job.ChatID
+	name := strings.ReplaceAll(job.Name(), "/", "_")
+	dir := filepath.Join(b.Config.AppConfig.DownloadPath, ".archives", fmt.Sprintf("job-%d", job.ID))
+	archive := server.TorrentFile{
+		Name: name + job.Archive.Ext(),
+		Path: filepath.Join(dir, name+job.Archive.Ext()),
+	}
+	defer os.RemoveAll(dir)
+
+	// the same selection archived before is sent again without packing it
+	key := server.FileCacheKey(job.Downloader.InfoHash(),
+		fmt.Sprintf("archive%s%v", job.Archive.Ext(), job.Downloader.SelectedFiles()))
+	caption := fmt.Sprintf("File: %s", archive.Name)
+	if b.sendCached(chatID, key, "", archive, caption) {
+		b.sendUploadSummary(job, []uploadResult{{name: archive.Name}}, 0)
+		return true
+	}
+
+	updateMsg := tgbotapi.NewEditMessageText(chatID, job.ProgressMsgID,
+		jobHeader(job)+fmt.Sprintf("Download complete! Packing %d files into a %s archive...", len(files), job.Archive))
+	b.Sender.Send(updateMsg)
+
+	// multi-file torrents keep their top directory, a single file sits at the top itself
+	root := ""
+	if len(job.Files) > 1 {
+		root = name
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = server.WriteArchive(archive.Path, job.Archive, root, files)
+	}
+	if err != nil {
+		b.Logger.LogError("Failed to archive job %d: %v", job.ID, err)
+		b.sendUploadSummary(job, []uploadResult{{name: archive.Name, err: fmt.Errorf("creating archive: %w", err)}}, 0)
+		return false
+	}
+	if job.Status() == JobCancelled {
+		return false
+	}
+
+	updateMsg = tgbotapi.NewEditMessageText(chatID, job.ProgressMsgID,
+		jobHeader(job)+fmt.Sprintf("Uploading %s...", archive.Name))
+	b.Sender.Send(updateMsg)
+
+	results := []uploadResult{{name: archive.Name, err: b.uploadFile(job, archive, key)}}
+	b.sendUploadSummary(job, results, 0)
+	return uploadSucceeded(results)
+}
+
+// uploadSucceeded reports whether every upload went through
+func uploadSucceeded(results []uploadResult) bool {
+	for _, result := range results {
+		if result.err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// sendUploadSummary reports which files arrived and why the others did not,
+// failures first since they are what the user has to act on. skipped counts
+// files sent before a restart
+func (b *Bot) sendUploadSummary(job *Job, results []uploadResult, skipped int) {
+	var failed, sent []string
+	for _, result := range results {
+		if result.err != nil {
+			failed = append(failed, fmt.Sprintf("❌ %s: %v", result.name, result.err))
+		} else {
+			sent = append(sent, "✅ "+result.name)
+		}
+	}
+
+	var sb strings.Builder
+	if len(failed) == 0 {
+		sb.WriteString(fmt.Sprintf("%s: upload complete, %d of %d files sent! Send another magnet link to download more files.\n", job.Label(), len(sent), len(results)))
+	} else {
+		sb.WriteString(fmt.Sprintf("%s: uploaded %d of %d files, %d failed.\n", job.Label(), len(sent), len(results), len(failed)))
+	}
+	if skipped > 0 {
+		sb.WriteString(fmt.Sprintf("%d more files were sent before the restart.\n", skipped))
+	}
+
+	lines := append(failed, sent...)
+	for i, line := range lines {
+		if sb.Len()+len(line) > summaryLength {
+			sb.WriteString(fmt.Sprintf("... and %d more", len(lines)-i))
+			break
+		}
+		sb.WriteString("\n" + line)
+	}
+
+	if _, err := b.Sender.Send(tgbotapi.NewMessage(job.ChatID, sb.String())); err != nil {
+		b.Logger.LogError("Failed to send upload summary for job %d: %v", job.ID, err)
+	}
+}
+
+// uploadBatches keeps the file order and groups consecutive photos into
+// albums of up to mediaGroupSize, every other file is sent on its own
+func (b *Bot) uploadBatches(files []server.TorrentFile) [][]server.TorrentFile {
+	var batches [][]server.TorrentFile
+	var album []server.TorrentFile
+	flush := func() {
+		if len(album) > 0 {
+			batches = append(batches, album)
+			album = nil
+		}
+	}
+
+	for _, file := range files {
+		info, err := os.Stat(file.Path)
+		if err != nil || !b.isPhoto(file, info.Size()) {
+			flush()
+			batches = append(batches, []server.TorrentFile{file})
+			continue
+		}
+		album = append(album, file)
+		if len(album) == mediaGroupSize {
+			flush()
+		}
+	}
+	flush()
+	return batches
+}
+
+// uploadAlbum sends photos as a media group, one by one if Telegram rejects the group.
+// Albums whose photos were all sent before go out by file_id
+func (b *Bot) uploadAlbum(job *Job, files []server.TorrentFile) []uploadResult {
+	results := make([]uploadResult, 0, len(files))
+	sent := func() []uploadResult {
+		for _, file := range files {
+			results = append(results, uploadResult{name: file.Name})
+		}
+		return results
+	}
+
+	if cached := b.cachedAlbum(job, files); cached != nil {
+		if _, err := b.sendAlbum(job.ChatID, files, cached); err == nil {
+			return sent()
+		}
+		b.Logger.LogError("Cached album of job %d was rejected, uploading again", job.ID)
+	}
+
+	uploads := make([]tgbotapi.RequestFileData, len(files))
+	var err error
+	for i, file := range files {
+		if uploads[i], err = b.uploadSource(file.Path, filepath.Base(file.Name)); err != nil {
+			break
+		}
+	}
+
+	var msgs []tgbotapi.Message
+	if err == nil {
+		msgs, err = b.sendAlbum(job.ChatID, files, uploads)
+	}
+	if err == nil {
+		for i, msg := range msgs {
+			if i < len(files) {
+				b.cacheUpload(fileKey(job, files[i]), msg, files[i].Size, "")
+			}
+		}
+		return sent()
+	}
+
+	b.Logger.LogError("Failed to upload album of %d photos, sending them one by one: %v", len(files), err)
+	for _, file := range files {
+		if job.Status() == JobCancelled {
+			break
+		}
+		results = append(results, uploadResult{name: file.Name, err: b.uploadFile(job, file, fileKey(job, file))})
+	}
+	return results
+}
+
+// cachedAlbum returns the file_ids of the photos when every one of them is cached, nil otherwise
+func (b *Bot) cachedAlbum(job *Job, files []server.TorrentFile) []tgbotapi.RequestFileData {
+	ids := make([]tgbotapi.RequestFileData, 0, len(files))
+	for _, file := range files {
+		cached, found := b.cachedFile(fileKey(job, file), "")
+		if !found || parseMediaKind(cached.Kind) != mediaPhoto {
+			return nil
+		}
+		ids = append(ids, tgbotapi.FileID(cached.FileID))
+	}
+	return ids
+}
+
+// uploadFile sends one downloaded file, in parts when it is over the upload limit.
+// Files Telegram already has, under key or with the same content, are sent by file_id
+func (b *Bot) uploadFile(job *Job, file server.TorrentFile, key string) error {
+	chatID := job.ChatID
+
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > b.Config.AppConfig.MaxFileSize {
+		if job.LinkLarge && b.Links != nil {
+			err := b.sendLink(job, file, info.Size())
+			if err == nil {
+				return nil
+			}
+			b.Logger.LogError("Failed to send link to %s, sending parts instead: %v", file.Name, err)
+		}
+		return b.uploadParts(job, file, key)
+	}
+
+	// Check if it's a readable text file
+	fileExt := strings.ToLower(filepath.Ext(file.Name))
+	if isTextFile(fileExt) && info.Size() < 4096 { // Telegram message limit
+		// Read file content and send as text
+		content, err := os.ReadFile(file.Path)
+		if err == nil {
+			textMsg := tgbotapi.NewMessage(chatID, fmt.Sprintf("File: %s\n\n```\n%s\n```", file.Name, string(content)))
+			textMsg.ParseMode = "Markdown"
+			if _, err := b.Sender.Send(textMsg); err == nil {
+				return nil // Skip document upload
+			}
+		}
+	}
+
+	kind := mediaKindOf(file.Name)
+	if kind == mediaPhoto && !b.isPhoto(file, info.Size()) {
+		kind = mediaDocument
+	}
+	caption := fmt.Sprintf("File: %s", file.Name)
+
+	if b.sendCached(chatID, key, "", file, caption) {
+		return nil
+	}
+	// hashing is much cheaper than uploading the same bytes again
+	contentHash, err := b.contentHash(job, file.Path)
+	if err != nil {
+		b.Logger.LogError("Failed to hash %s: %v", file.Name, err)
+	} else if b.sendCached(chatID, key, contentHash, file, caption) {
+		return nil
+	}
+
+	msg, err := b.sendFile(chatID, kind, file, caption)
+	if err != nil && kind != mediaDocument {
+		// Telegram rejects media it cannot process, a document always works
+		b.Logger.LogError("Failed to send %s as media, sending as document: %v", file.Name, err)
+		msg, err = b.sendFile(chatID, mediaDocument, file, caption)
+	}
+	if err != nil {
+		b.Logger.LogError("Failed to upload file %s: %v", file.Name, err)
+		return err
+	}
+
+	b.cacheUpload(key, msg, info.Size(), contentHash)
+	return nil
+}
+
+// sendFile sends file as kind
+func (b *Bot) sendFile(chatID int64, kind mediaKind, file server.TorrentFile, caption string) (tgbotapi.Message, error) {
+	fileUpload, err := b.uploadSource(file.Path, filepath.Base(file.Name))
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	return b.sendMedia(chatID, kind, file, fileUpload, caption)
+}
+
+// uploadParts sends a file over the upload limit as numbered parts, in order.
+// Each part is read from the file in place, nothing is copied to disk. Parts
+// sent before are sent by file_id
+func (b *Bot) uploadParts(job *Job, file server.TorrentFile, key string) error {
+	chatID := job.ChatID
+	partSize := partSize(b.Config.AppConfig.MaxFileSize)
+
+	if b.sendCachedParts(job, file, key) {
+		return nil
+	}
+
+	parts, err := server.SplitFile(file.Path, partSize)
+	if err != nil {
+		b.Logger.LogError("Failed to split file %s: %v", file.Name, err)
+		return fmt.Errorf("splitting: %w", err)
+	}
+	b.Logger.LogInfo("Uploading %s in %d parts", file.Name, len(parts))
+
+	for i, part := range parts {
+		if job.Status() == JobCancelled {
+			return errors.New("cancelled")
+		}
+
+		// a local Bot API server cannot take a part by path, its bytes are always sent
+		doc := tgbotapi.NewDocument(chatID, partFile{part})
+		doc.Caption = partCaption(file.Name, i+1, len(parts))
+		msg, err := b.Sender.Send(doc)
+		if err != nil {
+			// later parts are useless without this one
+			b.Logger.LogError("Failed to upload part %d of %s: %v", i+1, file.Name, err)
+			return fmt.Errorf("part %d of %d: %w", i+1, len(parts), err)
+		}
+		b.cacheUpload(partKey(key, i+1, len(parts), partSize), msg, 0, "")
+
+		if i < len(parts)-1 {
+			time.Sleep(1 * time.Second)
+		}
+	}
+	b.sendRejoinHint(chatID, file.Name)
+	return nil
+}
+
+// sendLink sends a signed download link to a file over the upload limit.
+// Temporary files such as archives cannot be linked and return an error
+func (b *Bot) sendLink(job *Job, file server.TorrentFile, size int64) error {
+	link, expires, err := b.Links.URL(job.ChatID, file.Path)
+	if err != nil {
+		return err
+	}
+
+	msg := tgbotapi.NewMessage(job.ChatID, fmt.Sprintf("File: %s (%s)\nToo large for Telegram, download it here:\n%s\n\nThe link works until %s.",
+		file.Name, server.FormatBytes(size), link, expires.Format("2006-01-02 15:04 MST")))
+	msg.DisableWebPagePreview = true
+	_, err = b.Sender.Send(msg)
+	return err
+}
+
+// sendCachedParts sends a split file by file_id when every part was sent before
+func (b *Bot) sendCachedParts(job *Job, file server.TorrentFile, key string) bool {
+	partSize := partSize(b.Config.AppConfig.MaxFileSize)
+	count := int((file.Size + partSize - 1) / partSize)
+	if info, err := os.Stat(file.Path); err == nil {
+		count = int((info.Size() + partSize - 1) / partSize)
+	}
+
+	ids := make([]string, 0, count)
+	for i := 1; i <= count; i++ {
+		cached, found := b.cachedFile(partKey(key, i, count, partSize), "")
+		if !found {
+			return false
+		}
+		ids = append(ids, cached.FileID)
+	}
+
+	for i, id := range ids {
+		doc := tgbotapi.NewDocument(job.ChatID, tgbotapi.FileID(id))
+		doc.Caption = partCaption(file.Name, i+1, count)
+		if _, err := b.Sender.Send(doc); err != nil {
+			// parts already sent stay, the upload starts over with all of them
+			b.Logger.LogError("Cached part %d of %s was rejected, uploading again: %v", i+1, file.Name, err)
+			return false
+		}
+	}
+	b.sendRejoinHint(job.ChatID, file.Name)
+	b.Logger.LogInfo("Sent %d parts of %s from the file_id cache", count, file.Name)
+	return true
+}
+
+// partSize is the size of the parts of files over limit. Telegram counts its
+// limits in decimal megabytes and the multipart request adds bytes of its own,
+// so parts stay a megabyte below the limit read as MB: 49 MB for 50 MiB
+func partSize(limit int64) int64 {
+	const mib, mb = 1 << 20, 1000 * 1000
+	if size := (limit/mib - 1) * mb; size > 0 {
+		return size
+	}
+	return max(limit/2, 1)
+}
+
+// captionNameMax keeps part captions well under Telegram's 1024 characters,
+// even when every character of the name takes two UTF-16 units
+const captionNameMax = 400
+
+// partCaption labels part index of count of the file name
+func partCaption(name string, index, count int) string {
+	return fmt.Sprintf("%s (part %d/%d)", shortenName(name, captionNameMax), index, count)
+}
+
+// sendRejoinHint tells once, after the last part, how to rejoin the parts of name
+func (b *Bot) sendRejoinHint(chatID int64, name string) {
+	if _, err := b.Sender.Send(tgbotapi.NewMessage(chatID, rejoinHint(filepath.Base(name)))); err != nil {
+		b.Logger.LogError("Failed to send rejoin instructions for %s: %v", name, err)
+	}
+}
+
+// uploadSource returns what to hand to Telegram for the file at path. With a
+// local Bot API server the file is passed by path, otherwise its bytes are streamed
+func (b *Bot) uploadSource(path, name string) (tgbotapi.RequestFileData, error) {
+	if b.Config.AppConfig.TelegramLocalFiles {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		return tgbotapi.FileURL("file://" + absPath), nil
+	}
+	return diskFile{path: path, name: name}, nil
+}
+
+// diskFile streams a file from disk under the given name. Unlike FileReader
+// it opens the file for every attempt, so the Sender can retry the request
+type diskFile struct {
+	path string
+	name string
+}
+
+func (f diskFile) NeedsUpload() bool {
+	return true
+}
+
+func (f diskFile) UploadData() (string, io.Reader, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return "", nil, err
+	}
+	return f.name, file, nil
+}
+
+func (f diskFile) SendData() string {
+	panic("diskFile must be uploaded")
+}
+
+// partFile streams one part of a split file, reopened for every attempt like diskFile
+type partFile struct {
+	part server.FilePart
+}
+
+func (f partFile) NeedsUpload() bool {
+	return true
+}
+
+func (f partFile) UploadData() (string, io.Reader, error) {
+	reader, err := f.part.Open()
+	if err != nil {
+		return "", nil, err
+	}
+	return f.part.Name, reader, nil
+}
+
+func (f partFile) SendData() string {
+	panic("partFile must be uploaded")
+}
+
+// rejoinHint explains how to put the parts of name back together
+func rejoinHint(name string) string {
+	return fmt.Sprintf("Download all parts, then rejoin them with:\n"+
+		"Linux/macOS: cat \"%s\".* > \"%s\"\n"+
+		"Windows: copy /b \"%s.001\"+\"%s.002\"+... \"%s\"\n"+
+		"or open %s with 7-Zip and extract.",
+		name, name, name, name, name, server.PartName(name, 1))
+}
+
+//  the file extension indicates a text file (able to upload)
+func isTextFile(ext string) bool {
+	textExtensions := map[string]bool{
+		".txt":  true,
+		".log":  true,
+		".md":   true,
+		".json": true,
+		".csv":  true,
+		".xml":  true,
+		".html": true,
+		".htm":  true,
+		".css":  true,
+		".js":   true,
+		".py":   true,
+		".go":   true,
+		".c":    true,
+		".cpp":  true,
+		".h":    true,
+		".java": true,
+		".php":  true,
+		".rb":   true,
+		".sh":   true,
+		".bat":  true,
+		".ps1":  true,
+		".yaml": true,
+		".yml":  true,
+		".toml": true,
+		".ini":  true,
+		".cfg":  true,
+		".conf": true,
+	}
+
+	return textExtensions[ext]
+}
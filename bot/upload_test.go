@@ -0,0 +1,51 @@
+package bot
+
+import (
+	"BotTelegram/server"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestPartSizeBelowLimit(t *testing.T) {
+	for _, limit := range []int64{50 << 20, 2000 << 20, 10 << 20, 3 << 20, 1 << 20} {
+		// a sparse file a bit over twice the limit
+		path := filepath.Join(t.TempDir(), "big.iso")
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Truncate(2*limit + 1); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+
+		parts, err := server.SplitFile(path, partSize(limit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, part := range parts {
+			if part.Size >= limit {
+				t.Errorf("limit %d: %s is %d bytes", limit, part.Name, part.Size)
+			}
+		}
+	}
+	if size := partSize(50 << 20); size > 49*1000*1000 {
+		t.Errorf("parts for the public Bot API are %d bytes, over Telegram's 50 MB with overhead", size)
+	}
+}
+
+func TestPartCaptionLength(t *testing.T) {
+	name := ""
+	for range 300 {
+		name += "名字😀"
+	}
+	caption := partCaption(name+".mkv", 12, 40)
+	if n := len(utf16.Encode([]rune(caption))); n > 1024 {
+		t.Errorf("caption is %d characters, Telegram takes 1024", n)
+	}
+	if short := partCaption("movie.mkv", 1, 3); short != "movie.mkv (part 1/3)" {
+		t.Errorf("caption = %q", short)
+	}
+}
@@ -2,18 +2,79 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"github.com/joho/godotenv"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 
+// Upload limits of the public Bot API and of a self-hosted telegram-bot-api server
+const (
+	cloudMaxFileSize int64 = 50 * 1024 * 1024
+	localMaxFileSize int64 = 2000 * 1024 * 1024
+)
+
 type Config struct {
 	TelegramToken string
+
+	// Base URL of a self-hosted Bot API server, empty for api.telegram.org
+	TelegramAPIURL string
+	// Upload by local path, the server must run with --local and see DownloadPath
+	TelegramLocalFiles bool
+
 	DownloadPath  string
 	LogPath       string
 	MaxFileSize   int64 
+
+	// Job queue limits
+	MaxConcurrentDownloads int
+	MaxUserDownloads       int
+
+	// Port the shared torrent engine listens on for peers
+	TorrentPort int
+
+	// bbolt file holding jobs and other state that survives restarts
+	DatabasePath string
+
+	// How long shutdown waits for uploads in progress
+	ShutdownTimeout time.Duration
+
+	// Requests per second sent to Telegram across all chats
+	TelegramRateLimit int
+
+	// Download links, enabled when PublicURL is set
+	HTTPAddr   string
+	PublicURL  string
+	LinkSecret string // HMAC key, generated and kept in the database when empty
+	LinkTTL    time.Duration
+
+	// Users and chats allowed to use the bot, by ID, with their role name.
+	// At least one admin is required
+	AllowedUsers map[int64]string
+	// Let users who are not on the allowlist in with the user role
+	AllowEveryone bool
+
+	// Quota of users without one of their own, zero is unlimited
+	QuotaStorage int64 // bytes of downloaded data kept on disk
+	QuotaDaily   int64 // bytes downloaded per day
+	QuotaMonthly int64 // bytes downloaded per month
+	QuotaJobs    int   // unfinished jobs at once
+
+	// Free space kept on the download disk, downloads pause below it
+	DiskReserve int64
+
+	// What happens to downloaded data: "forever", "upload", "days", "size" or "ratio"
+	RetentionPolicy  string
+	RetentionDays    int     // age at which data is removed, also the fallback of "upload" and "ratio"
+	RetentionMaxSize int64   // bytes kept under "size", least recently used data goes first
+	RetentionRatio   float64 // upload ratio "ratio" seeds to
+	JanitorInterval  time.Duration
+	// Let the janitor remove data in DownloadPath that no download accounts for
+	JanitorRemoveUntracked bool
 }
 
 func LoadConfig() (*Config, error) {
@@ -33,6 +94,11 @@ func LoadConfig() (*Config, error) {
 		}
 		downloadPath = filepath.Join(homeDir, "Downloads", "BotTelegram")
 	}
+	// file paths are joined to it and made relative to it again, both must be absolute
+	downloadPath, err := filepath.Abs(downloadPath)
+	if err != nil {
+		return nil, err
+	}
 
 	logPath := os.Getenv("LOG_PATH")
 	if logPath == "" {
@@ -46,21 +112,136 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 
-	// Telegram's max file size is 50MB by default, but can be increased to 2GB for bots in channels/groups
-	// TODO: Check Group guidlines for larger files
+	telegramAPIURL := strings.TrimRight(os.Getenv("TELEGRAM_API_URL"), "/")
+	telegramLocalFiles, _ := strconv.ParseBool(os.Getenv("TELEGRAM_LOCAL_FILES"))
+
+	// Telegram's max file size is 50MB for the public Bot API, a self-hosted server raises it to 2000MB
+	defaultMaxFileSize := cloudMaxFileSize
+	if telegramAPIURL != "" {
+		defaultMaxFileSize = localMaxFileSize
+	}
 	maxFileSizeStr := os.Getenv("MAX_FILE_SIZE")
-	var maxFileSize int64 = 50 * 1024 * 1024 // 50 MB default
+	maxFileSize := defaultMaxFileSize
 	if maxFileSizeStr != "" {
 		var err error
 		maxFileSize, err = strconv.ParseInt(maxFileSizeStr, 10, 64)
 		if err != nil {
-			maxFileSize = 50 * 1024 * 1024
+			maxFileSize = defaultMaxFileSize
 		}
 	}
+	if telegramAPIURL != "" && maxFileSize > localMaxFileSize {
+		maxFileSize = localMaxFileSize
+	}
+
+	// How many torrents download at once, in total and per user
+	maxConcurrentDownloads := getEnvInt("MAX_CONCURRENT_DOWNLOADS", 3)
+	maxUserDownloads := getEnvInt("MAX_USER_DOWNLOADS", 2)
+
+	torrentPort := getEnvInt("TORRENT_PORT", 42069)
+
+	databasePath := os.Getenv("DATABASE_PATH")
+	if databasePath == "" {
+		databasePath = filepath.Join(downloadPath, ".bot.db")
+	}
+
+	shutdownTimeout := time.Duration(getEnvInt("SHUTDOWN_TIMEOUT", 30)) * time.Second
+
+	// Telegram allows about 30 messages per second in total, stay below it
+	telegramRateLimit := getEnvInt("TELEGRAM_RATE_LIMIT", 25)
+
+	// The HTTP server serves files behind signed links at PUBLIC_URL
+	httpAddr := os.Getenv("HTTP_ADDR")
+	if httpAddr == "" {
+		httpAddr = ":8080"
+	}
+	publicURL := strings.TrimRight(os.Getenv("PUBLIC_URL"), "/")
+	linkTTL := time.Duration(getEnvInt("LINK_TTL_HOURS", 24)) * time.Hour
+
+	// Per-user limits are given in MB
+	quotaStorage := int64(getEnvInt("QUOTA_STORAGE_MB", 0)) << 20
+	quotaDaily := int64(getEnvInt("QUOTA_DAILY_MB", 0)) << 20
+	quotaMonthly := int64(getEnvInt("QUOTA_MONTHLY_MB", 0)) << 20
+	quotaJobs := getEnvInt("QUOTA_JOBS", 0)
+
+	diskReserve := int64(getEnvInt("DISK_RESERVE_MB", 1024)) << 20
+
+	retentionPolicy := strings.ToLower(os.Getenv("RETENTION_POLICY"))
+	if retentionPolicy == "" {
+		retentionPolicy = "forever"
+	}
+	retentionRatio := 1.0
+	if value, err := strconv.ParseFloat(os.Getenv("RETENTION_RATIO"), 64); err == nil && value > 0 {
+		retentionRatio = value
+	}
+
+	allowedUsers, err := parseAllowedUsers(os.Getenv("ALLOWED_USERS"))
+	if err != nil {
+		return nil, err
+	}
+	allowEveryone, _ := strconv.ParseBool(os.Getenv("ALLOW_EVERYONE"))
+	removeUntracked, _ := strconv.ParseBool(os.Getenv("JANITOR_REMOVE_UNTRACKED"))
+
 	return &Config{
-		TelegramToken: telegramToken,
-		DownloadPath:  downloadPath,
-		LogPath:       logPath,
-		MaxFileSize:   maxFileSize,
+		TelegramToken:          telegramToken,
+		TelegramAPIURL:         telegramAPIURL,
+		TelegramLocalFiles:     telegramLocalFiles,
+		DownloadPath:           downloadPath,
+		LogPath:                logPath,
+		MaxFileSize:            maxFileSize,
+		MaxConcurrentDownloads: maxConcurrentDownloads,
+		MaxUserDownloads:       maxUserDownloads,
+		TorrentPort:            torrentPort,
+		DatabasePath:           databasePath,
+		ShutdownTimeout:        shutdownTimeout,
+		TelegramRateLimit:      telegramRateLimit,
+		HTTPAddr:               httpAddr,
+		PublicURL:              publicURL,
+		LinkSecret:             os.Getenv("LINK_SECRET"),
+		LinkTTL:                linkTTL,
+		AllowedUsers:           allowedUsers,
+		AllowEveryone:          allowEveryone,
+		QuotaStorage:           quotaStorage,
+		QuotaDaily:             quotaDaily,
+		QuotaMonthly:           quotaMonthly,
+		QuotaJobs:              quotaJobs,
+		DiskReserve:            diskReserve,
+		RetentionPolicy:        retentionPolicy,
+		RetentionDays:          getEnvInt("RETENTION_DAYS", 7),
+		RetentionMaxSize:       int64(getEnvInt("RETENTION_MAX_SIZE_MB", 100*1024)) << 20,
+		RetentionRatio:         retentionRatio,
+		JanitorInterval:        time.Duration(getEnvInt("JANITOR_INTERVAL_MINUTES", 60)) * time.Minute,
+		JanitorRemoveUntracked: removeUntracked,
 	}, nil
 }
+
+// parseAllowedUsers reads a comma separated list of user or chat IDs, each
+// optionally followed by :role. Entries without a role get "user"
+func parseAllowedUsers(value string) (map[int64]string, error) {
+	users := make(map[int64]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, role, found := strings.Cut(entry, ":")
+		if !found {
+			role = "user"
+		}
+		userID, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("ALLOWED_USERS: invalid ID %q", id)
+		}
+		users[userID] = strings.ToLower(strings.TrimSpace(role))
+	}
+	return users, nil
+}
+
+// getEnvInt reads a positive integer from the environment, falling back to def
+func getEnvInt(key string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return def
+	}
+	return value
+}
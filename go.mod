@@ -3,39 +3,95 @@ module BotTelegram
 go 1.22
 
 require (
-	github.com/cenkalti/rain v1.12.8
+	github.com/anacrolix/torrent v1.56.1
 	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
 	github.com/joho/godotenv v1.5.1
+	go.etcd.io/bbolt v1.3.8
 )
-// Indirect usage: 
+
+// Indirect usage:
+require (
+	github.com/RoaringBitmap/roaring v1.2.3 // indirect
+	github.com/ajwerner/btree v0.0.0-20211221152037-f427b3e689c0 // indirect
+	github.com/alecthomas/atomic v0.1.0-alpha2 // indirect
+	github.com/anacrolix/chansync v0.3.0 // indirect
+	github.com/anacrolix/dht/v2 v2.19.2-0.20221121215055-066ad8494444 // indirect
+	github.com/anacrolix/envpprof v1.3.0 // indirect
+	github.com/anacrolix/generics v0.0.2-0.20240227122613-f95486179cab // indirect
+	github.com/anacrolix/go-libutp v1.3.1 // indirect
+	github.com/anacrolix/log v0.15.2 // indirect
+	github.com/anacrolix/missinggo v1.3.0 // indirect
+	github.com/anacrolix/missinggo/perf v1.0.0 // indirect
+	github.com/anacrolix/missinggo/v2 v2.7.3 // indirect
+	github.com/anacrolix/mmsg v1.0.0 // indirect
+	github.com/anacrolix/multiless v0.3.0 // indirect
+	github.com/anacrolix/stm v0.4.0 // indirect
+	github.com/anacrolix/sync v0.5.1 // indirect
+	github.com/anacrolix/upnp v0.1.4 // indirect
+	github.com/anacrolix/utp v0.1.0 // indirect
+	github.com/bahlo/generic-list-go v0.2.0 // indirect
+	github.com/benbjohnson/immutable v0.3.0 // indirect
+	github.com/bits-and-blooms/bitset v1.2.2 // indirect
+	github.com/bradfitz/iter v0.0.0-20191230175014-e8f45d346db8 // indirect
+	github.com/cespare/xxhash v1.1.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dustin/go-humanize v1.0.0 // indirect
+	github.com/edsrzf/mmap-go v1.1.0 // indirect
+	github.com/go-llsqlite/adapter v0.0.0-20230927005056-7f5ce7f0c916 // indirect
+	github.com/go-llsqlite/crawshaw v0.5.2-0.20240425034140-f30eb7704568 // indirect
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/huandu/xstrings v1.3.2 // indirect
+	github.com/mschoch/smat v0.2.0 // indirect
+	github.com/pion/datachannel v1.5.2 // indirect
+	github.com/pion/dtls/v2 v2.2.4 // indirect
+	github.com/pion/ice/v2 v2.2.6 // indirect
+	github.com/pion/interceptor v0.1.11 // indirect
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/mdns v0.0.5 // indirect
+	github.com/pion/randutil v0.1.0 // indirect
+	github.com/pion/rtcp v1.2.9 // indirect
+	github.com/pion/rtp v1.7.13 // indirect
+	github.com/pion/sctp v1.8.2 // indirect
+	github.com/pion/sdp/v3 v3.0.5 // indirect
+	github.com/pion/srtp/v2 v2.0.9 // indirect
+	github.com/pion/stun v0.3.5 // indirect
+	github.com/pion/transport v0.13.1 // indirect
+	github.com/pion/transport/v2 v2.0.0 // indirect
+	github.com/pion/turn/v2 v2.0.8 // indirect
+	github.com/pion/udp v0.1.4 // indirect
+	github.com/pion/webrtc/v3 v3.1.42 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	github.com/rs/dnscache v0.0.0-20211102005908-e0241e321417 // indirect
+	github.com/stretchr/testify v1.8.4 // indirect
+	github.com/tidwall/btree v1.6.0 // indirect
+	go.opentelemetry.io/otel v1.8.0 // indirect
+	go.opentelemetry.io/otel/trace v1.8.0 // indirect
+	golang.org/x/net v0.23.0 // indirect
+	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/time v0.0.0-20220609170525-579cf78fd858 // indirect
+	modernc.org/libc v1.22.3 // indirect
+	modernc.org/mathutil v1.5.0 // indirect
+	modernc.org/memory v1.5.0 // indirect
+	modernc.org/sqlite v1.21.1 // indirect
+	zombiezen.com/go/sqlite v0.13.1 // indirect
+)
+
+// Indirect usage:
 require (
-	github.com/cenkalti/backoff/v3 v3.2.2 
-	github.com/cenkalti/log v1.0.0 
-	github.com/gofrs/uuid v4.4.0+incompatible 
-	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da 
-	github.com/google/btree v1.1.2 
-	github.com/hashicorp/errwrap v1.1.0 
-	github.com/hashicorp/go-multierror v1.1.1 
-	github.com/jackpal/bencode-go v1.0.0 
-	github.com/juju/ratelimit v1.0.2 
-	github.com/klauspost/cpuid/v2 v2.2.6 
-	github.com/mattn/go-isatty v0.0.20 
-	github.com/minio/sha256-simd v1.0.1 
-	github.com/mitchellh/go-homedir v1.1.0 
-	github.com/mr-tron/base58 v1.2.0 
-	github.com/multiformats/go-multihash v0.2.3 
-	github.com/multiformats/go-varint v0.0.7 
-	github.com/nictuku/dht v0.0.0-20201226073453-fd1c1dd3d66a 
-	github.com/nictuku/nettools v0.0.0-20150117095333-8867a2107ad3 
-	github.com/powerman/rpc-codec v1.2.2 
-	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475 
-	github.com/spaolacci/murmur3 v1.1.0 
-	github.com/youtube/vitess v3.0.0-rc.3+incompatible 
-	github.com/zeebo/bencode v1.0.0 
-	go.etcd.io/bbolt v1.3.8 
-	golang.org/x/crypto v0.17.0 
-	golang.org/x/exp v0.0.0-20231226003508-02704c960a9b 
-	golang.org/x/sys v0.15.0 
-	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c 
-	lukechampine.com/blake3 v1.2.1 
+	github.com/google/btree v1.1.2 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.6 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/minio/sha256-simd v1.0.1 // indirect
+	github.com/mr-tron/base58 v1.2.0 // indirect
+	github.com/multiformats/go-multihash v0.2.3 // indirect
+	github.com/multiformats/go-varint v0.0.7 // indirect
+	github.com/spaolacci/murmur3 v1.1.0 // indirect
+	golang.org/x/crypto v0.21.0 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	lukechampine.com/blake3 v1.2.1 // indirect
 )
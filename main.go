@@ -4,10 +4,12 @@ import (
 	"BotTelegram/bot"
 	"BotTelegram/config"
 	"BotTelegram/server"
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -35,8 +37,61 @@ func main() {
 		log.Fatalf("Failed to initialize bot: %v", err)
 	}
 
+	// Init torrent engine, shared by every download
+	engine, err := server.NewEngine(cfg.DownloadPath, cfg.TorrentPort, logger)
+	if err != nil {
+		logger.LogError("Failed to initialize torrent engine: %v", err)
+		log.Fatalf("Failed to initialize torrent engine: %v", err)
+	}
+	defer engine.Close()
+
+	// Init database for jobs that survive restarts
+	db, err := server.OpenDatabase(cfg.DatabasePath)
+	if err != nil {
+		logger.LogError("Failed to open database: %v", err)
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	// closed only once no job goroutine can write to it any more
+	jobsStopped := false
+	defer func() {
+		if !jobsStopped {
+			logger.LogError("Uploads are still running, leaving the database open")
+			return
+		}
+		db.Close()
+	}()
+
+	// Media details and thumbnails, with ffmpeg when it is installed
+	prober := server.NewProber(logger)
+
+	// Download and streaming links, served over HTTP
+	var links *server.FileLinks
+	if cfg.PublicURL != "" {
+		secret := []byte(cfg.LinkSecret)
+		if len(secret) == 0 {
+			if secret, err = db.Secret("links", 32); err != nil {
+				logger.LogError("Failed to load link secret: %v", err)
+				log.Fatalf("Failed to load link secret: %v", err)
+			}
+		}
+		links = server.NewFileLinks(cfg.DownloadPath, cfg.PublicURL, secret, cfg.LinkTTL)
+
+		httpServer := server.NewServer(links, engine, db, logger)
+		go func() {
+			if err := httpServer.Start(cfg.HTTPAddr); err != nil {
+				logger.LogError("HTTP server error: %v", err)
+			}
+		}()
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			httpServer.Shutdown(ctx)
+		}()
+	}
+
 	// Start Bot
-	telegramBot := bot.NewBot(botCfg, logger)
+	telegramBot := bot.NewBot(botCfg, engine, db, prober, links, logger)
+	telegramBot.ResumeJobs()
 	logger.LogInfo("Bot initialized. Starting...")
 
 	c := make(chan os.Signal, 1)
@@ -52,6 +107,9 @@ func main() {
 	// Wait for interrupt signal
 	<-c
 	logger.LogInfo("Shutdown signal received, closing bot...")
-	# TODO: MVP-2 Add cleanup 
+
+	// Stop updates and downloads, wait for uploads. The deferred closes then
+	// run in reverse order: HTTP server, database, engine and finally the logger
+	jobsStopped = telegramBot.Shutdown(cfg.ShutdownTimeout)
 	logger.LogInfo("Bot shutdown complete")
 }
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// ArchiveFormat is how a job's files are bundled before upload, empty to send them one by one
+type ArchiveFormat string
+
+const (
+	ArchiveNone  ArchiveFormat = ""
+	ArchiveZip   ArchiveFormat = "zip"
+	ArchiveTarGz ArchiveFormat = "tar.gz"
+)
+
+// Ext is the file extension of the format including the dot
+func (f ArchiveFormat) Ext() string {
+	return "." + string(f)
+}
+
+// WriteArchive streams files into a new archive at dest. Entries are stored
+// under root followed by the file's path in the torrent, so the torrent's
+// directory structure is kept
+func WriteArchive(dest string, format ArchiveFormat, root string, files []TorrentFile) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriterSize(out, 1<<20)
+	switch format {
+	case ArchiveZip:
+		err = writeZip(buf, root, files)
+	case ArchiveTarGz:
+		err = writeTarGz(buf, root, files)
+	default:
+		err = fmt.Errorf("unknown archive format %q", format)
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
+
+func writeZip(w io.Writer, root string, files []TorrentFile) error {
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		info, err := os.Stat(file.Path)
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(root, file.Name)
+		header.Method = zip.Deflate
+
+		entry, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := copyFile(entry, file.Path); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarGz(w io.Writer, root string, files []TorrentFile) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		info, err := os.Stat(file.Path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(root, file.Name)
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := copyFile(tw, file.Path); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Database is the bot's persistent state, one bbolt file with a bucket per feature
+type Database struct {
+	db *bbolt.DB
+}
+
+// OpenDatabase opens (or creates) the database file at path
+func OpenDatabase(path string) (*Database, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Database{db: db}, nil
+}
+
+// Close flushes and closes the database file
+func (d *Database) Close() error {
+	return d.db.Close()
+}
+
+var secretsBucket = []byte("secrets")
+
+// Secret returns the random secret stored under name, creating one of size
+// bytes on first use so signatures stay valid across restarts
+func (d *Database) Secret(name string, size int) ([]byte, error) {
+	var secret []byte
+	err := d.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(secretsBucket)
+		if err != nil {
+			return err
+		}
+		if stored := bucket.Get([]byte(name)); stored != nil {
+			secret = append([]byte(nil), stored...)
+			return nil
+		}
+
+		secret = make([]byte, size)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), secret)
+	})
+	return secret, err
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package server
+
+import "errors"
+
+// FreeSpace is not implemented on this platform, disk space checks are skipped
+func FreeSpace(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -1,14 +1,26 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
-	"github.com/cenkalti/rain/torrent"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+var (
+	// ErrNoFilesSelected - the selection is empty, there is nothing to download
+	ErrNoFilesSelected = errors.New("no files selected")
+	// ErrDownloaderClosed - Close was called, e.g. while the metadata was fetched
+	ErrDownloaderClosed = errors.New("download was cancelled")
 )
 
 // DownloadProgress - state of a download
@@ -20,107 +32,228 @@ type DownloadProgress struct {
 	Peers           int
 }
 
+// FilePriority - how eagerly the engine fetches a file's pieces
+type FilePriority int
+
+const (
+	PrioritySkip FilePriority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p FilePriority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// piecePriority maps our priority onto the engine's piece priority
+func (p FilePriority) piecePriority() torrent.PiecePriority {
+	switch p {
+	case PrioritySkip:
+		return torrent.PiecePriorityNone
+	case PriorityHigh:
+		return torrent.PiecePriorityHigh
+	default:
+		return torrent.PiecePriorityNormal
+	}
+}
+
 // File with it's path
+// Name is the path relative to the torrent root with '/' separators, unique within the torrent.
+// Pieces [FirstPiece, EndPiece) hold the file's data, boundary pieces are shared with neighbours
 type TorrentFile struct {
-	ID       int
-	Name     string
-	Path     string
-	Selected bool
+	ID         int
+	Name       string
+	Path       string
+	Size       int64
+	FirstPiece int
+	EndPiece   int
+	Selected   bool
+	Priority   FilePriority
 }
 
-// Handler
+// Handler - one torrent of one job, added to the shared engine
 type Downloader struct {
-	session      *torrent.Session
+	engine       *Engine
 	torrent      *torrent.Torrent
 	downloadPath string
 	files        []TorrentFile
+	started      bool
+	stopStream   context.CancelFunc // ends the sequential read started by Stream
+	closed       chan struct{}      // closed by Close, aborts the metadata wait
 	logger       *Logger
 	mu           sync.Mutex
 }
 
-func NewDownloader(downloadPath string, logger *Logger) *Downloader {
+func NewDownloader(engine *Engine, logger *Logger) *Downloader {
 	if logger == nil {
 		// Create a default logger that outputs to stdout if none provided
-		log, _ := NewLogger(filepath.Join(downloadPath, "logs"), true)
+		log, _ := NewLogger(filepath.Join(engine.DownloadPath(), "logs"), true)
 		logger = log
 	}
 
 	return &Downloader{
-		downloadPath: downloadPath,
+		engine:       engine,
+		downloadPath: engine.DownloadPath(),
+		closed:       make(chan struct{}),
 		logger:       logger,
 	}
 }
 
 // GetTorrentInfo retrieves information about the torrent without starting the download
 func (d *Downloader) GetTorrentInfo(magnetLink string) ([]TorrentFile, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	// Add magnet link
+	tor, err := d.add(func() (*torrent.Torrent, error) {
+		return d.engine.AddMagnet(d, magnetLink)
+	})
+	if err != nil {
+		d.logger.LogError("Failed to add magnet URI: %v", err)
+		return nil, err
+	}
+
+	return d.loadFiles(tor)
+}
 
-	// session config
-	cfg := torrent.DefaultConfig
-	cfg.DataDir = d.downloadPath
+// GetTorrentInfoFromFile is GetTorrentInfo for the contents of a .torrent file
+func (d *Downloader) GetTorrentInfoFromFile(r io.Reader) ([]TorrentFile, error) {
+	mi, err := metainfo.Load(r)
+	if err != nil {
+		d.logger.LogError("Failed to parse torrent file: %v", err)
+		return nil, fmt.Errorf("invalid torrent file: %w", err)
+	}
 
-	// new session
-	ses, err := torrent.NewSession(cfg)
+	tor, err := d.add(func() (*torrent.Torrent, error) {
+		return d.engine.AddTorrent(d, mi)
+	})
 	if err != nil {
-		d.logger.LogError("Failed to create torrent session: %v", err)
+		d.logger.LogError("Failed to add torrent file: %v", err)
 		return nil, err
 	}
-	d.session = ses
 
-	// Add magnet link
-	tor, err := ses.AddURI(magnetLink, nil)
+	return d.loadFiles(tor)
+}
+
+// add runs addTorrent unless the downloader was closed and keeps the torrent it returns
+func (d *Downloader) add(addTorrent func() (*torrent.Torrent, error)) (*torrent.Torrent, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	select {
+	case <-d.closed:
+		return nil, ErrDownloaderClosed
+	default:
+	}
+
+	tor, err := addTorrent()
 	if err != nil {
-		d.logger.LogError("Failed to add magnet URI: %v", err)
 		return nil, err
 	}
 	d.torrent = tor
+	return tor, nil
+}
 
-	// Wait for metadata and inform user
+// loadFiles waits for the metadata of tor and builds the file list.
+// d.mu is not held while waiting, so Close can abort the wait
+func (d *Downloader) loadFiles(tor *torrent.Torrent) ([]TorrentFile, error) {
+	// Wait for metadata, nothing is downloaded until priorities are applied
 	d.logger.LogInfo("Fetching torrent metadata...")
-	metadataComplete := make(chan struct{})
-	go func() {
-		for range time.Tick(time.Second) {
-			s := tor.Stats()
-			if s.Status == torrent.Downloading ||
-				s.Status == torrent.Stopped ||
-				s.Status == torrent.Seeding {
-				close(metadataComplete)
-				return
-			}
-		}
-	}()
-
-	
 	select {
-	case <-metadataComplete:
+	case <-tor.GotInfo():
 		// Metadata fetched successfully
+	case <-d.closed:
+		return nil, ErrDownloaderClosed
 	case <-time.After(60 * time.Second): // This can be prolonged for rare low seed usage
 		return nil, errors.New("timeout while fetching torrent metadata")
 	}
 
-	// Populate files list
-	torrentFiles, err := tor.Files()
-	if err != nil {
-		return nil, err
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.torrent != tor {
+		// closed after the metadata arrived
+		return nil, ErrDownloaderClosed
 	}
 
+	// Populate files list
+	torrentFiles := tor.Files()
 	d.files = make([]TorrentFile, len(torrentFiles))
 
 	for i, file := range torrentFiles {
 		d.files[i] = TorrentFile{
-			ID:       i,
-			Name:     filepath.Base(file.Path()),
-			Path:     file.Path(),
-			Selected: true,
+			ID:         i,
+			Name:       file.DisplayPath(),
+			Path:       file.Path(),
+			Size:       file.Length(),
+			FirstPiece: file.BeginPieceIndex(),
+			EndPiece:   file.EndPieceIndex(),
+			Selected:   true,
+			Priority:   PriorityNormal,
 		}
 	}
-	
-	tor.Stop()
+
+	d.started = false
 	return d.files, nil
 }
 
-// Important Feature - Lets user select files to download (Not availabe for IOS users in ISH + rtorrent usage) 
+// Name returns the torrent name, empty until a torrent is added
+func (d *Downloader) Name() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.torrent == nil {
+		return ""
+	}
+	return d.torrent.Name()
+}
+
+// InfoHash returns the hex info hash of the torrent
+func (d *Downloader) InfoHash() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.torrent == nil {
+		return ""
+	}
+	return d.torrent.InfoHash().HexString()
+}
+
+// Metainfo returns the .torrent encoding of the torrent, so it can be re-added without peers
+func (d *Downloader) Metainfo() ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.torrent == nil || d.torrent.Info() == nil {
+		return nil, errors.New("no torrent metadata")
+	}
+
+	var buf bytes.Buffer
+	if err := d.torrent.Metainfo().Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SelectedFiles returns the IDs of the selected files
+func (d *Downloader) SelectedFiles() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var ids []int
+	for _, file := range d.files {
+		if file.Selected {
+			ids = append(ids, file.ID)
+		}
+	}
+	return ids
+}
+
+// Important Feature - Lets user select files to download (Not availabe for IOS users in ISH + rtorrent usage)
+// Files not in fileIDs are skipped, their pieces are never requested from peers
 func (d *Downloader) SelectFiles(fileIDs []int) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -129,25 +262,114 @@ func (d *Downloader) SelectFiles(fileIDs []int) error {
 		return errors.New("no active torrent")
 	}
 
-	// map for quick lookup 
+	// map for quick lookup
 	selectedMap := make(map[int]bool)
 	for _, id := range fileIDs {
 		selectedMap[id] = true
 	}
 
-	// Update selection status
+	// Update selection status, keep a high priority if it was set before
 	for i := range d.files {
+		switch {
+		case !selectedMap[i]:
+			d.files[i].Priority = PrioritySkip
+		case d.files[i].Priority == PrioritySkip:
+			d.files[i].Priority = PriorityNormal
+		}
 		d.files[i].Selected = selectedMap[i]
 	}
 
-	/**File selection is done by the torrent client, and not by setting priorities 
-	The torrent client will download the files selected by default
-	if not selected they are skiped 
-	The d.files array contain the selected files
-	**/
+	if d.started {
+		d.applyPriorities()
+	}
 	return nil
 }
 
+// SetFilePriority changes the priority of a single file, PrioritySkip deselects it
+func (d *Downloader) SetFilePriority(fileID int, priority FilePriority) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.torrent == nil {
+		return errors.New("no active torrent")
+	}
+	if fileID < 0 || fileID >= len(d.files) {
+		return fmt.Errorf("invalid file id: %d", fileID)
+	}
+
+	d.files[fileID].Priority = priority
+	d.files[fileID].Selected = priority != PrioritySkip
+
+	if d.started {
+		d.applyPriorities()
+	}
+	return nil
+}
+
+// applyPriorities hands the file priorities to the engine. Caller holds d.mu
+func (d *Downloader) applyPriorities() {
+	priorities := make([]FilePriority, len(d.files))
+	for i, file := range d.files {
+		priorities[i] = file.Priority
+	}
+
+	if err := d.engine.SetPriorities(d, d.torrent, priorities); err != nil {
+		d.logger.LogError("Failed to apply file priorities: %v", err)
+	}
+}
+
+// selectedProgress sums the engine's progress over the selected files only.
+// An empty selection is an error, not a finished download
+func (d *Downloader) selectedProgress() (completed, total int64, peers int, done bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.torrent == nil {
+		return 0, 0, 0, false, errors.New("no active torrent")
+	}
+
+	done = true
+	selected := 0
+	peers = d.torrent.Stats().ActivePeers
+	torrentFiles := d.torrent.Files()
+	for i, file := range d.files {
+		if !file.Selected || i >= len(torrentFiles) {
+			continue
+		}
+		selected++
+		completed += torrentFiles[i].BytesCompleted()
+		total += torrentFiles[i].Length()
+		for _, piece := range torrentFiles[i].State() {
+			if !piece.Complete {
+				done = false
+				break
+			}
+		}
+	}
+	if selected == 0 {
+		return 0, 0, peers, false, ErrNoFilesSelected
+	}
+	return completed, total, peers, done, nil
+}
+
+// BytesCompleted returns how much of the selected files is on disk
+func (d *Downloader) BytesCompleted() int64 {
+	completed, _, _, _, _ := d.selectedProgress()
+	return completed
+}
+
+// UploadedBytes returns how much torrent data was sent to peers since the torrent was added
+func (d *Downloader) UploadedBytes() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.torrent == nil {
+		return 0
+	}
+	stats := d.torrent.Stats()
+	return stats.BytesWrittenData.Int64()
+}
+
 // Download starts downloading selected files from a torrent
 // Returns a channel that will receive progress updates
 func (d *Downloader) Download() (chan DownloadProgress, error) {
@@ -158,11 +380,15 @@ func (d *Downloader) Download() (chan DownloadProgress, error) {
 	if d.torrent == nil {
 		return nil, errors.New("no active torrent")
 	}
+	if !slices.ContainsFunc(d.files, func(file TorrentFile) bool { return file.Selected }) {
+		return nil, ErrNoFilesSelected
+	}
 
 	// To update user of the prog we make a channel
 	progressChan := make(chan DownloadProgress)
 
-	d.torrent.Start()
+	d.applyPriorities()
+	d.started = true
 	d.logger.LogInfo("Starting download of selected files")
 
 	// goroutine for monitoring progress
@@ -171,37 +397,42 @@ func (d *Downloader) Download() (chan DownloadProgress, error) {
 
 		for range time.Tick(time.Second) {
 			// Check if torrent is still valid
-			if d.torrent == nil {
-				d.logger.LogError("Torrent is no longer valid")
+			completed, total, peers, done, err := d.selectedProgress()
+			if err != nil {
+				d.logger.LogError("Stopped monitoring download: %v", err)
 				return
 			}
 
-			s := d.torrent.Stats()
 			// Precentage for readability
 			var percentComplete float64
-			if s.Bytes.Total > 0 {
-				percentComplete = float64(s.Bytes.Completed) / float64(s.Bytes.Total) * 100
+			if total > 0 {
+				percentComplete = float64(completed) / float64(total) * 100
+			}
+
+			status := "Downloading"
+			if done {
+				status = "Completed"
 			}
 
 			// user is updated
 			progressInfo := DownloadProgress{
-				Status:          s.Status.String(),
+				Status:          status,
 				PercentComplete: percentComplete,
-				BytesCompleted:  s.Bytes.Completed,
-				BytesTotal:      s.Bytes.Total,
-				Peers:           s.Peers.Total,
+				BytesCompleted:  completed,
+				BytesTotal:      total,
+				Peers:           peers,
 			}
 
 			progressChan <- progressInfo
 
-			// Proggress update can be more/less 
+			// Proggress update can be more/less
 			if int(percentComplete)%10 == 0 {
 				d.logger.LogInfo("Download progress: %.2f%% (Status: %s, Peers: %d)",
-					percentComplete, s.Status.String(), s.Peers.Total)
+					percentComplete, status, peers)
 			}
 
-			// if seeding download is done
-			if s.Status == torrent.Seeding {
+			// all selected pieces are verified, download is done
+			if done {
 				d.logger.LogInfo("Download complete")
 				return
 			}
@@ -221,19 +452,17 @@ func (d *Downloader) GetDownloadedFiles() ([]TorrentFile, error) {
 	}
 
 	// Update file status
-	torrentFiles, err := d.torrent.Files()
-	if err != nil {
-		return nil, errors.New("problem loading torrent files")
-	}
+	torrentFiles := d.torrent.Files()
 
 	for i, file := range torrentFiles {
 		if i < len(d.files) && d.files[i].Selected {
 			// Check if file exists and update its path
-			fullPath := filepath.Join(d.downloadPath, file.Path())
+			fullPath := d.engine.filePath(file)
 			if _, err := os.Stat(fullPath); err == nil {
 				d.files[i].Path = fullPath
 			} else {
-				foundPath, err := findFileInSubdirectories(d.downloadPath, file.Path())
+				dir := torrentDir(d.downloadPath, nil, d.torrent.InfoHash())
+				foundPath, err := findFileInSubdirectories(dir, file.Path())
 				if err == nil {
 					d.files[i].Path = foundPath
 				}
@@ -248,6 +477,9 @@ func (d *Downloader) GetDownloadedFiles() ([]TorrentFile, error) {
 			downloadedFiles = append(downloadedFiles, file)
 		}
 	}
+	if len(downloadedFiles) == 0 {
+		return nil, ErrNoFilesSelected
+	}
 
 	return downloadedFiles, nil
 }
@@ -280,10 +512,19 @@ func (d *Downloader) Close() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if d.session != nil {
-		d.session.Close()
-		d.session = nil
+	select {
+	case <-d.closed:
+	default:
+		close(d.closed)
+	}
+	if d.stopStream != nil {
+		d.stopStream()
+		d.stopStream = nil
+	}
+	if d.torrent != nil {
+		d.engine.Release(d, d.torrent)
 		d.torrent = nil
+		d.started = false
 	}
 
 	d.logger.LogInfo("Downloader closed")
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// Engine is the torrent client shared by every download in the process.
+// It owns the listen port, the DHT node and the piece completion database.
+type Engine struct {
+	client       *torrent.Client
+	completion   storage.PieceCompletion
+	downloadPath string
+	logger       *Logger
+
+	mu       sync.Mutex
+	torrents map[metainfo.Hash]*sharedTorrent
+	paused   bool // no data is downloaded, see PauseDownloads
+}
+
+// sharedTorrent - a torrent and the downloaders using it.
+// Two users adding the same torrent get the same engine torrent, so the
+// file priorities are merged and the torrent is dropped with its last user.
+type sharedTorrent struct {
+	torrent    *torrent.Torrent
+	priorities map[*Downloader][]FilePriority
+}
+
+func NewEngine(downloadPath string, listenPort int, logger *Logger) (*Engine, error) {
+	completion, err := storage.NewBoltPieceCompletion(downloadPath)
+	if err != nil {
+		return nil, fmt.Errorf("open piece completion database: %w", err)
+	}
+
+	cfg := torrent.NewDefaultClientConfig()
+	cfg.DataDir = downloadPath
+	cfg.ListenPort = listenPort
+	cfg.DefaultStorage = storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir:   downloadPath,
+		TorrentDirMaker: torrentDir,
+		PieceCompletion: completion,
+	})
+
+	client, err := torrent.NewClient(cfg)
+	if err != nil {
+		completion.Close()
+		return nil, fmt.Errorf("create torrent client: %w", err)
+	}
+	logger.LogInfo("Torrent engine listening on port %d", client.LocalPort())
+
+	return &Engine{
+		client:       client,
+		completion:   completion,
+		downloadPath: downloadPath,
+		logger:       logger,
+		torrents:     make(map[metainfo.Hash]*sharedTorrent),
+	}, nil
+}
+
+// DownloadPath is the directory torrent data is written to
+func (e *Engine) DownloadPath() string {
+	return e.downloadPath
+}
+
+// torrentDir keeps every torrent in a directory named after its info hash,
+// so torrents with the same name or file paths never write to the same files
+func torrentDir(baseDir string, _ *metainfo.Info, infoHash metainfo.Hash) string {
+	return filepath.Join(baseDir, infoHash.HexString())
+}
+
+// filePath is where a file of a torrent is stored on disk
+func (e *Engine) filePath(file *torrent.File) string {
+	return filepath.Join(torrentDir(e.downloadPath, nil, file.Torrent().InfoHash()), filepath.FromSlash(file.Path()))
+}
+
+// AddMagnet adds a magnet link on behalf of owner
+func (e *Engine) AddMagnet(owner *Downloader, uri string) (*torrent.Torrent, error) {
+	tor, err := e.client.AddMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	e.hold(owner, tor)
+	return tor, nil
+}
+
+// AddTorrent adds parsed .torrent metainfo on behalf of owner
+func (e *Engine) AddTorrent(owner *Downloader, mi *metainfo.MetaInfo) (*torrent.Torrent, error) {
+	tor, err := e.client.AddTorrent(mi)
+	if err != nil {
+		return nil, err
+	}
+	e.hold(owner, tor)
+	return tor, nil
+}
+
+func (e *Engine) hold(owner *Downloader, tor *torrent.Torrent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	shared, ok := e.torrents[tor.InfoHash()]
+	if !ok {
+		shared = &sharedTorrent{
+			torrent:    tor,
+			priorities: make(map[*Downloader][]FilePriority),
+		}
+		e.torrents[tor.InfoHash()] = shared
+		if e.paused {
+			tor.DisallowDataDownload()
+		}
+	}
+	// nil until the owner starts downloading
+	shared.priorities[owner] = nil
+}
+
+// SetPriorities records the file priorities wanted by owner and applies the
+// highest priority any owner wants for each file
+func (e *Engine) SetPriorities(owner *Downloader, tor *torrent.Torrent, priorities []FilePriority) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	shared, ok := e.torrents[tor.InfoHash()]
+	if !ok {
+		return errors.New("torrent is not held by the engine")
+	}
+	shared.priorities[owner] = priorities
+	shared.apply()
+	return nil
+}
+
+// Release drops owner's interest in tor, the torrent is removed once nobody holds it
+func (e *Engine) Release(owner *Downloader, tor *torrent.Torrent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	shared, ok := e.torrents[tor.InfoHash()]
+	if !ok {
+		return
+	}
+	delete(shared.priorities, owner)
+
+	if len(shared.priorities) > 0 {
+		shared.apply()
+		return
+	}
+	delete(e.torrents, tor.InfoHash())
+	tor.Drop()
+}
+
+// apply pushes the merged priorities to the engine. Caller holds the engine lock
+func (s *sharedTorrent) apply() {
+	if s.torrent.Info() == nil {
+		return
+	}
+
+	for i, file := range s.torrent.Files() {
+		merged := PrioritySkip
+		for _, priorities := range s.priorities {
+			if i < len(priorities) && priorities[i] > merged {
+				merged = priorities[i]
+			}
+		}
+		file.SetPriority(merged.piecePriority())
+	}
+}
+
+// PauseDownloads stops downloading data for every torrent, including ones
+// added later, until ResumeDownloads. Metadata is still fetched and seeding goes on
+func (e *Engine) PauseDownloads() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.paused = true
+	for _, shared := range e.torrents {
+		shared.torrent.DisallowDataDownload()
+	}
+}
+
+// ResumeDownloads undoes PauseDownloads
+func (e *Engine) ResumeDownloads() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.paused = false
+	for _, shared := range e.torrents {
+		shared.torrent.AllowDataDownload()
+	}
+}
+
+// Paused reports whether downloads are paused
+func (e *Engine) Paused() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.paused
+}
+
+// Close shuts down the client and the completion database
+func (e *Engine) Close() {
+	e.mu.Lock()
+	e.torrents = make(map[metainfo.Hash]*sharedTorrent)
+	e.mu.Unlock()
+
+	e.client.Close()
+	if err := e.completion.Close(); err != nil {
+		e.logger.LogError("Failed to close piece completion database: %v", err)
+	}
+	e.logger.LogInfo("Torrent engine closed")
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// sameNameContents are the contents of E01.mkv in the two torrents of sameNameTorrents
+var sameNameContents = [2]string{"first episode", "another first episode"}
+
+// sameNameTorrents builds two torrents both named Show with a file E01.mkv, but different content
+func sameNameTorrents(t *testing.T) [2]*metainfo.MetaInfo {
+	t.Helper()
+	var torrents [2]*metainfo.MetaInfo
+	for i, content := range sameNameContents {
+		src := filepath.Join(t.TempDir(), "Show")
+		if err := os.MkdirAll(src, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, "E01.mkv"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		info := metainfo.Info{PieceLength: 16 << 10}
+		if err := info.BuildFromFilePath(src); err != nil {
+			t.Fatal(err)
+		}
+		infoBytes, err := bencode.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		torrents[i] = &metainfo.MetaInfo{InfoBytes: infoBytes}
+	}
+	return torrents
+}
+
+func TestTorrentDirKeepsSameNamesApart(t *testing.T) {
+	root := t.TempDir()
+	files := storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir:   root,
+		TorrentDirMaker: torrentDir,
+		PieceCompletion: storage.NewMapPieceCompletion(),
+	})
+	defer files.Close()
+
+	torrents := sameNameTorrents(t)
+	for i, mi := range torrents {
+		info, err := mi.UnmarshalInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		impl, err := files.OpenTorrent(&info, mi.HashInfoBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(sameNameContents[i])
+		if _, err := impl.Piece(info.Piece(0)).WriteAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, mi := range torrents {
+		path := filepath.Join(root, mi.HashInfoBytes().HexString(), "Show", "E01.mkv")
+		data, err := os.ReadFile(path)
+		want := sameNameContents[i]
+		if err != nil || string(data) != want {
+			t.Errorf("torrent %d: %s = %q, %v, want %q", i, path, data, err, want)
+		}
+	}
+}
+
+func TestDownloadedFilesOfSameNameTorrents(t *testing.T) {
+	root := t.TempDir()
+	logger, err := NewLogger(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	engine, err := NewEngine(root, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	var downloaders [2]*Downloader
+	for i, mi := range sameNameTorrents(t) {
+		var buf bytes.Buffer
+		if err := mi.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		downloaders[i] = NewDownloader(engine, logger)
+		defer downloaders[i].Close()
+		if _, err := downloaders[i].GetTorrentInfoFromFile(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := downloaders[i].SelectFiles([]int{0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the first torrent has its file on disk
+	first := filepath.Join(root, downloaders[0].InfoHash(), "Show", "E01.mkv")
+	if err := os.MkdirAll(filepath.Dir(first), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(first, []byte(sameNameContents[0]), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := downloaders[0].GetDownloadedFiles()
+	if err != nil || len(files) != 1 || files[0].Path != first {
+		t.Errorf("first torrent files = %+v, %v, want %s", files, err, first)
+	}
+	files, err = downloaders[1].GetDownloadedFiles()
+	if err != nil || len(files) != 1 || files[0].Path == first {
+		t.Errorf("second torrent files = %+v, %v, want them apart from %s", files, err, first)
+	}
+}
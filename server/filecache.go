@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	fileIDsBucket    = []byte("file_ids")
+	fileHashesBucket = []byte("file_ids_by_hash")
+)
+
+// CachedFile is a file Telegram already has, sent again by its file_id
+type CachedFile struct {
+	FileID      string `json:"file_id"`
+	Kind        string `json:"kind"` // send method the file_id belongs to, e.g. "document" or "video"
+	Size        int64  `json:"size"`
+	ContentHash string `json:"content_hash,omitempty"`
+}
+
+// FileCacheKey identifies a file of a torrent, or anything made from it when
+// name is not a path in the torrent (e.g. an archive of a selection)
+func FileCacheKey(infoHash, name string) string {
+	return infoHash + "/" + name
+}
+
+// HashFile returns the hex SHA-256 of the file's content
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CachedFile looks up an earlier upload by key
+func (d *Database) CachedFile(key string) (CachedFile, bool, error) {
+	return d.cachedFile(fileIDsBucket, key)
+}
+
+// CachedContent looks up an earlier upload of the same bytes, whatever torrent they came from
+func (d *Database) CachedContent(contentHash string) (CachedFile, bool, error) {
+	return d.cachedFile(fileHashesBucket, contentHash)
+}
+
+func (d *Database) cachedFile(bucketName []byte, key string) (CachedFile, bool, error) {
+	var file CachedFile
+	var found bool
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &file)
+	})
+	return file, found, err
+}
+
+// CacheFile stores the file_id of an upload under key and, when known, its content hash
+func (d *Database) CacheFile(key string, file CachedFile) error {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(fileIDsBucket)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(key), data); err != nil {
+			return err
+		}
+
+		if file.ContentHash == "" {
+			return nil
+		}
+		hashes, err := tx.CreateBucketIfNotExists(fileHashesBucket)
+		if err != nil {
+			return err
+		}
+		return hashes.Put([]byte(file.ContentHash), data)
+	})
+}
+
+// ForgetFile removes a file_id Telegram no longer accepts
+func (d *Database) ForgetFile(key string, file CachedFile) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket(fileIDsBucket); bucket != nil {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		if hashes := tx.Bucket(fileHashesBucket); hashes != nil && file.ContentHash != "" {
+			return hashes.Delete([]byte(file.ContentHash))
+		}
+		return nil
+	})
+}
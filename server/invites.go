@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var invitesBucket = []byte("invites")
+
+var (
+	ErrInviteInvalid = errors.New("invalid invite code")
+	ErrInviteExpired = errors.New("invite code expired")
+	ErrInviteUsedUp  = errors.New("invite code already used")
+)
+
+// InviteRecord is an invite code that adds whoever redeems it to the allowlist
+type InviteRecord struct {
+	Code      string    `json:"code"`
+	Role      string    `json:"role"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedBy int64     `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Active reports whether the code can still be redeemed
+func (r InviteRecord) Active() bool {
+	return r.Uses < r.MaxUses && time.Now().Before(r.ExpiresAt)
+}
+
+// NewInviteCode returns a random code that fits in a t.me/<bot>?start= link
+func NewInviteCode() (string, error) {
+	code := make([]byte, 9)
+	if _, err := rand.Read(code); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(code), nil
+}
+
+// SaveInvite inserts or replaces an invite
+func (d *Database) SaveInvite(record InviteRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(invitesBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(record.Code), data)
+	})
+}
+
+// DeleteInvite removes an invite, missing invites are not an error
+func (d *Database) DeleteInvite(code string) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(invitesBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(code))
+	})
+}
+
+// ListInvites returns every stored invite, including expired and used up ones
+func (d *Database) ListInvites() ([]InviteRecord, error) {
+	var records []InviteRecord
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(invitesBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, data []byte) error {
+			var record InviteRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// RedeemInvite uses up one use of code and adds userID to the allowlist with
+// the invite's role, in one transaction so a code is never used more often
+// than allowed
+func (d *Database) RedeemInvite(code string, userID int64) (UserRecord, error) {
+	var user UserRecord
+	err := d.db.Update(func(tx *bbolt.Tx) error {
+		invites := tx.Bucket(invitesBucket)
+		if invites == nil {
+			return ErrInviteInvalid
+		}
+		data := invites.Get([]byte(code))
+		if data == nil {
+			return ErrInviteInvalid
+		}
+
+		var invite InviteRecord
+		if err := json.Unmarshal(data, &invite); err != nil {
+			return err
+		}
+		switch {
+		case invite.Uses >= invite.MaxUses:
+			return ErrInviteUsedUp
+		case !time.Now().Before(invite.ExpiresAt):
+			return ErrInviteExpired
+		}
+
+		invite.Uses++
+		data, err := json.Marshal(invite)
+		if err != nil {
+			return err
+		}
+		if err := invites.Put([]byte(code), data); err != nil {
+			return err
+		}
+
+		user = UserRecord{ID: userID, Role: invite.Role, AddedBy: invite.CreatedBy, AddedAt: time.Now()}
+		data, err = json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		users, err := tx.CreateBucketIfNotExists(usersBucket)
+		if err != nil {
+			return err
+		}
+		return users.Put(userKey(userID), data)
+	})
+	return user, err
+}
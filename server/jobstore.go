@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"go.etcd.io/bbolt"
+)
+
+var jobsBucket = []byte("jobs")
+
+// JobRecord is what survives a restart of a job: enough to re-add the
+// torrent, restore the selection and find the progress message again
+type JobRecord struct {
+	ID            int    `json:"id"`
+	ChatID        int64  `json:"chat_id"`
+	UserID        int64  `json:"user_id,omitempty"`
+	Name          string `json:"name"`
+	MagnetLink    string `json:"magnet_link,omitempty"`
+	InfoHash      string `json:"info_hash"`
+	Metainfo      []byte `json:"metainfo"`
+	SelectedFiles []int  `json:"selected_files"`
+	Archive       string `json:"archive,omitempty"`
+	LinkLarge     bool   `json:"link_large,omitempty"`
+	UploadedFiles []int  `json:"uploaded_files,omitempty"`
+	ProgressMsgID int    `json:"progress_msg_id"`
+	State         string `json:"state"`
+}
+
+// SaveJob inserts or replaces a job record
+func (d *Database) SaveJob(record JobRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(jobsBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(jobKey(record.ID), data)
+	})
+}
+
+// DeleteJob removes a job record, missing records are not an error
+func (d *Database) DeleteJob(id int) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(jobKey(id))
+	})
+}
+
+// ListJobs returns every stored job ordered by ID
+func (d *Database) ListJobs() ([]JobRecord, error) {
+	var records []JobRecord
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, data []byte) error {
+			var record JobRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// NextJobID hands out a job ID that was never used before. The counter is
+// kept in the database, so IDs are not reused after a restart and download
+// records of earlier jobs keep theirs
+func (d *Database) NextJobID() (int, error) {
+	var id uint64
+	err := d.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(jobsBucket)
+		if err != nil {
+			return err
+		}
+
+		// databases from before the counter only know the IDs of their records
+		last := bucket.Sequence()
+		for _, name := range [][]byte{jobsBucket, downloadsBucket} {
+			if records := tx.Bucket(name); records != nil {
+				if key, _ := records.Cursor().Last(); key != nil {
+					last = max(last, binary.BigEndian.Uint64(key))
+				}
+			}
+		}
+		if err := bucket.SetSequence(last); err != nil {
+			return err
+		}
+
+		id, err = bucket.NextSequence()
+		return err
+	})
+	return int(id), err
+}
+
+// big endian keys keep bbolt's byte order equal to the job order
+func jobKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
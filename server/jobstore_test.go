@@ -0,0 +1,47 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNextJobID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.db")
+	db, err := OpenDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a database from before the counter: the next ID follows the stored records
+	if err := db.SaveJob(JobRecord{ID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveDownload(DownloadRecord{JobID: 7}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int{8, 9} {
+		if id, err := db.NextJobID(); err != nil || id != want {
+			t.Fatalf("NextJobID() = %d, %v, want %d", id, err, want)
+		}
+	}
+
+	// IDs of removed records and of jobs that were never stored are not handed out again
+	if err := db.DeleteDownload(7); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteJob(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if id, err := db.NextJobID(); err != nil || id != 10 {
+		t.Fatalf("NextJobID() after a restart = %d, %v, want 10", id, err)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix of signed download URLs
+const linksPrefix = "/files/"
+
+var (
+	ErrLinkInvalid = errors.New("invalid link")
+	ErrLinkExpired = errors.New("link expired")
+)
+
+// FileLinks signs download URLs for files below root. A URL is
+// /files/<chat id>/<expiry>/<signature>/<path>, the HMAC covers the chat,
+// the expiry and the path, so a link only works for what and until when it was made
+type FileLinks struct {
+	root    string
+	baseURL string
+	secret  []byte
+	ttl     time.Duration
+}
+
+func NewFileLinks(root, baseURL string, secret []byte, ttl time.Duration) *FileLinks {
+	return &FileLinks{
+		root:    root,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		secret:  secret,
+		ttl:     ttl,
+	}
+}
+
+// URL makes a link to the file at filePath for chatID, valid for the configured TTL
+func (l *FileLinks) URL(chatID int64, filePath string) (string, time.Time, error) {
+	rel, err := l.relative(filePath)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expires := time.Now().Add(l.ttl).Truncate(time.Second)
+	segments := strings.Split(rel, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	link := fmt.Sprintf("%s%s%d/%d/%s/%s", l.baseURL, linksPrefix, chatID, expires.Unix(),
+		l.sign(chatID, expires.Unix(), rel), strings.Join(segments, "/"))
+	return link, expires, nil
+}
+
+// relative returns filePath relative to root with forward slashes. Files
+// outside root and hidden files, such as the databases and temporary parts, are refused
+func (l *FileLinks) relative(filePath string) (string, error) {
+	rel, err := filepath.Rel(l.root, filePath)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if !servablePath(rel) {
+		return "", fmt.Errorf("%s cannot be shared by link", filePath)
+	}
+	return rel, nil
+}
+
+// Resolve checks a request path made by URL and returns the file it points to
+func (l *FileLinks) Resolve(requestPath string) (filePath string, chatID int64, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(requestPath, linksPrefix), "/", 4)
+	if len(parts) != 4 {
+		return "", 0, ErrLinkInvalid
+	}
+
+	chatID, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", 0, ErrLinkInvalid
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, ErrLinkInvalid
+	}
+	rel := parts[3]
+
+	if !servablePath(rel) || !hmac.Equal([]byte(parts[2]), []byte(l.sign(chatID, expires, rel))) {
+		return "", 0, ErrLinkInvalid
+	}
+	if time.Now().Unix() > expires {
+		return "", chatID, ErrLinkExpired
+	}
+	return filepath.Join(l.root, filepath.FromSlash(rel)), chatID, nil
+}
+
+func (l *FileLinks) sign(chatID, expires int64, rel string) string {
+	mac := hmac.New(sha256.New, l.secret)
+	fmt.Fprintf(mac, "%d\n%d\n%s", chatID, expires, rel)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// servablePath accepts clean relative paths without hidden components
+func servablePath(rel string) bool {
+	if rel == "" || rel != path.Clean(rel) || path.IsAbs(rel) {
+		return false
+	}
+	for _, segment := range strings.Split(rel, "/") {
+		if segment == ".." || strings.HasPrefix(segment, ".") {
+			return false
+		}
+	}
+	return true
+}
@@ -66,6 +66,11 @@ func (l *Logger) LogDebug(format string, v ...interface{}) {
 	log.Printf("[DEBUG] %s", message)
 }
 
+// Close flushes the log file to disk and closes it
 func (l *Logger) Close() error {
+	if err := l.logFile.Sync(); err != nil {
+		l.logFile.Close()
+		return err
+	}
 	return l.logFile.Close()
 }
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// MediaInfo - what Telegram wants to know about a media file before it is sent.
+// Fields that could not be read are left zero
+type MediaInfo struct {
+	Duration  int // seconds
+	Width     int
+	Height    int
+	Title     string
+	Performer string
+}
+
+// Largest moov box read into memory, anything bigger is not a sane header
+const maxMoovSize = 64 << 20
+
+// Most of an ID3v2 tag read into memory. The size comes from the file, and
+// text frames come before large ones such as cover pictures in practice
+const maxID3Size = 1 << 20
+
+// ReadMediaInfo reads duration and dimensions from MP4/MOV headers, ID3 tags
+// from MP3 files and dimensions from JPEG/PNG images
+func ReadMediaInfo(path string) (MediaInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp4", ".m4v", ".mov", ".m4a":
+		return readMP4Info(f)
+	case ".mp3":
+		return readID3Info(f)
+	case ".jpg", ".jpeg", ".png":
+		cfg, _, err := image.DecodeConfig(f)
+		if err != nil {
+			return MediaInfo{}, err
+		}
+		return MediaInfo{Width: cfg.Width, Height: cfg.Height}, nil
+	}
+	return MediaInfo{}, errors.New("unsupported media format")
+}
+
+// readMP4Info takes the duration from mvhd and the size of the first visual track from tkhd
+func readMP4Info(f *os.File) (MediaInfo, error) {
+	moov, err := findMP4Box(f, "moov")
+	if err != nil {
+		return MediaInfo{}, err
+	}
+
+	var info MediaInfo
+	walkMP4Boxes(moov, func(kind string, body []byte) bool {
+		switch kind {
+		case "mvhd":
+			info.Duration = mvhdDuration(body)
+		case "trak":
+			return info.Width == 0
+		case "tkhd":
+			// width and height are 16.16 fixed point in the last 8 bytes
+			if len(body) >= 84 && info.Width == 0 {
+				info.Width = int(binary.BigEndian.Uint32(body[len(body)-8:]) >> 16)
+				info.Height = int(binary.BigEndian.Uint32(body[len(body)-4:]) >> 16)
+			}
+		}
+		return false
+	})
+	return info, nil
+}
+
+// findMP4Box reads the body of the top level box called kind
+func findMP4Box(f *os.File, kind string) ([]byte, error) {
+	var offset int64
+	header := make([]byte, 16)
+	for {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			return nil, errors.New("no " + kind + " box")
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// the box runs to the end of the file
+			info, err := f.Stat()
+			if err != nil {
+				return nil, err
+			}
+			size = info.Size() - offset
+		case 1:
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize {
+			return nil, errors.New("invalid MP4 box size")
+		}
+
+		if string(header[4:8]) == kind {
+			if size-headerSize > maxMoovSize {
+				return nil, errors.New(kind + " box too large")
+			}
+			body := make([]byte, size-headerSize)
+			if _, err := f.ReadAt(body, offset+headerSize); err != nil && err != io.EOF {
+				return nil, err
+			}
+			return body, nil
+		}
+		offset += size
+	}
+}
+
+// walkMP4Boxes calls visit for each box in data. Returning true descends into the box
+func walkMP4Boxes(data []byte, visit func(kind string, body []byte) bool) {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return
+		}
+		kind, body := string(data[4:8]), data[8:size]
+		if visit(kind, body) {
+			walkMP4Boxes(body, visit)
+		}
+		data = data[size:]
+	}
+}
+
+func mvhdDuration(body []byte) int {
+	if len(body) < 20 {
+		return 0
+	}
+	var timescale, duration uint64
+	if body[0] == 1 {
+		if len(body) < 32 {
+			return 0
+		}
+		timescale = uint64(binary.BigEndian.Uint32(body[20:24]))
+		duration = binary.BigEndian.Uint64(body[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(body[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(body[16:20]))
+	}
+	if timescale == 0 {
+		return 0
+	}
+	return int(duration / timescale)
+}
+
+// readID3Info reads title and performer from an ID3v2 tag, falling back to ID3v1
+func readID3Info(f *os.File) (MediaInfo, error) {
+	var info MediaInfo
+
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(f, header); err == nil && string(header[:3]) == "ID3" {
+		// frames cut off by the cap or a truncated file are skipped
+		tag := make([]byte, min(syncsafe(header[6:10]), maxID3Size))
+		n, _ := io.ReadFull(f, tag)
+		info.Title, info.Performer = id3v2Frames(tag[:n], header[3])
+	}
+
+	if info.Title == "" {
+		stat, err := f.Stat()
+		if err != nil {
+			return info, err
+		}
+		tag := make([]byte, 128)
+		if stat.Size() >= 128 {
+			if _, err := f.ReadAt(tag, stat.Size()-128); err == nil && string(tag[:3]) == "TAG" {
+				info.Title = trimID3v1(tag[3:33])
+				info.Performer = trimID3v1(tag[33:63])
+			}
+		}
+	}
+	return info, nil
+}
+
+// id3v2Frames picks the title and lead performer frames out of an ID3v2.2-2.4 tag
+func id3v2Frames(tag []byte, version byte) (title, performer string) {
+	idSize, headerSize := 4, 10
+	titleID, performerID := "TIT2", "TPE1"
+	if version == 2 {
+		idSize, headerSize = 3, 6
+		titleID, performerID = "TT2", "TP1"
+	}
+
+	for len(tag) >= headerSize && tag[0] != 0 {
+		id := string(tag[:idSize])
+		var size int
+		switch version {
+		case 2:
+			size = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(tag[4:8]))
+		default:
+			size = syncsafe(tag[4:8])
+		}
+		if size <= 0 || headerSize+size > len(tag) {
+			break
+		}
+
+		body := tag[headerSize : headerSize+size]
+		switch id {
+		case titleID:
+			title = id3Text(body)
+		case performerID:
+			performer = id3Text(body)
+		}
+		tag = tag[headerSize+size:]
+	}
+	return title, performer
+}
+
+// id3Text decodes a text frame body, the first byte names the encoding
+func id3Text(body []byte) string {
+	if len(body) < 2 {
+		return ""
+	}
+	encoding, text := body[0], body[1:]
+
+	var s string
+	switch encoding {
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(text) >= 2 && text[0] == 0xFE && text[1] == 0xFF {
+			bigEndian, text = true, text[2:]
+		} else if len(text) >= 2 && text[0] == 0xFF && text[1] == 0xFE {
+			bigEndian, text = false, text[2:]
+		}
+		units := make([]uint16, 0, len(text)/2)
+		for i := 0; i+1 < len(text); i += 2 {
+			if bigEndian {
+				units = append(units, binary.BigEndian.Uint16(text[i:]))
+			} else {
+				units = append(units, binary.LittleEndian.Uint16(text[i:]))
+			}
+		}
+		s = string(utf16.Decode(units))
+	case 3:
+		s = string(text)
+	default:
+		s = latin1(text)
+	}
+
+	// several values are separated by NUL, the first one is enough
+	if i := strings.IndexRune(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func trimID3v1(field []byte) string {
+	if i := bytes.IndexByte(field, 0); i >= 0 {
+		field = field[:i]
+	}
+	return strings.TrimSpace(latin1(field))
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// syncsafe decodes the 7 bits per byte integers used by ID3v2
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
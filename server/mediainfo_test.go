@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"unicode/utf16"
+)
+
+// mp4Box encodes a box with a 32-bit size
+func mp4Box(kind string, body ...[]byte) []byte {
+	data := bytes.Join(body, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+	return append(append(box, kind...), data...)
+}
+
+// mvhdV0 is a version 0 movie header with the given timescale and duration
+func mvhdV0(timescale, duration uint32) []byte {
+	body := make([]byte, 100)
+	binary.BigEndian.PutUint32(body[12:], timescale)
+	binary.BigEndian.PutUint32(body[16:], duration)
+	return mp4Box("mvhd", body)
+}
+
+// mvhdV1 is a version 1 movie header with 64-bit times
+func mvhdV1(timescale uint32, duration uint64) []byte {
+	body := make([]byte, 112)
+	body[0] = 1
+	binary.BigEndian.PutUint32(body[20:], timescale)
+	binary.BigEndian.PutUint64(body[24:], duration)
+	return mp4Box("mvhd", body)
+}
+
+// tkhd is a version 0 track header, width and height are 16.16 fixed point
+func tkhd(width, height int) []byte {
+	body := make([]byte, 84)
+	binary.BigEndian.PutUint32(body[76:], uint32(width)<<16)
+	binary.BigEndian.PutUint32(body[80:], uint32(height)<<16)
+	return mp4Box("tkhd", body)
+}
+
+func writeFixture(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadMediaInfoMP4(t *testing.T) {
+	ftyp := mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2"))
+	mdat := mp4Box("mdat", make([]byte, 1000))
+	audio := mp4Box("trak", tkhd(0, 0))
+	video := mp4Box("trak", tkhd(1920, 1080))
+
+	// mdat with a 64-bit size before moov, as written by some muxers
+	largeMdat := append(binary.BigEndian.AppendUint32(nil, 1), "mdat"...)
+	largeMdat = binary.BigEndian.AppendUint64(largeMdat, 16+500)
+	largeMdat = append(largeMdat, make([]byte, 500)...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want MediaInfo
+	}{
+		{"moov first", bytes.Join([][]byte{ftyp, mp4Box("moov", mvhdV0(1000, 90500), video), mdat}, nil),
+			MediaInfo{Duration: 90, Width: 1920, Height: 1080}},
+		{"moov last", bytes.Join([][]byte{ftyp, mdat, mp4Box("moov", mvhdV0(600, 6000), video)}, nil),
+			MediaInfo{Duration: 10, Width: 1920, Height: 1080}},
+		{"64-bit box before moov", bytes.Join([][]byte{ftyp, largeMdat, mp4Box("moov", mvhdV1(90000, 90000*3600), video)}, nil),
+			MediaInfo{Duration: 3600, Width: 1920, Height: 1080}},
+		{"audio track first", bytes.Join([][]byte{ftyp, mp4Box("moov", mvhdV0(1, 5), audio, video)}, nil),
+			MediaInfo{Duration: 5, Width: 1920, Height: 1080}},
+		{"zero timescale", bytes.Join([][]byte{mp4Box("moov", mvhdV0(0, 100), video)}, nil),
+			MediaInfo{Width: 1920, Height: 1080}},
+		{"short mvhd and tkhd", mp4Box("moov", mp4Box("mvhd", make([]byte, 10)), mp4Box("trak", mp4Box("tkhd", make([]byte, 20)))),
+			MediaInfo{}},
+		// a child box claiming more than its parent holds ends the walk
+		{"corrupt child size", mp4Box("moov", mvhdV0(1, 7), append(binary.BigEndian.AppendUint32(nil, 4000), "trak"...)),
+			MediaInfo{Duration: 7}},
+	}
+
+	for _, tt := range tests {
+		got, err := ReadMediaInfo(writeFixture(t, "video.mp4", tt.data))
+		if err != nil {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadMediaInfoMP4Errors(t *testing.T) {
+	moov := mp4Box("moov", mvhdV0(1000, 90500), mp4Box("trak", tkhd(640, 480)))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"no moov", mp4Box("ftyp", []byte("isom"))},
+		{"truncated header", moov[:5]},
+		{"box smaller than its header", append(binary.BigEndian.AppendUint32(nil, 3), "free"...)},
+		{"64-bit size smaller than its header", append(append(binary.BigEndian.AppendUint32(nil, 1), "free"...), make([]byte, 8)...)},
+		{"moov over the size cap", append(binary.BigEndian.AppendUint32(nil, maxMoovSize+100), "moov"...)},
+	}
+
+	for _, tt := range tests {
+		if got, err := ReadMediaInfo(writeFixture(t, "video.mov", tt.data)); err == nil {
+			t.Errorf("%s: got %+v, want an error", tt.name, got)
+		}
+	}
+
+	// moov cut short by the end of the file reads what is there
+	got, err := ReadMediaInfo(writeFixture(t, "video.m4v", moov[:len(moov)-40]))
+	if err != nil || got.Duration != 90 {
+		t.Errorf("truncated moov: got %+v, %v", got, err)
+	}
+}
+
+// id3Tag encodes an ID3v2 tag of version with the given frames, size is the tag size in the header
+func id3Tag(version byte, size int, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	if size < 0 {
+		size = len(body)
+	}
+	header := []byte{'I', 'D', '3', version, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(header, body...)
+}
+
+// id3Frame encodes a text frame with the frame header of version
+func id3Frame(version byte, id string, encoding byte, text []byte) []byte {
+	body := append([]byte{encoding}, text...)
+	switch version {
+	case 2:
+		return append([]byte{id[0], id[1], id[2], byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+	case 3:
+		frame := append([]byte(id), binary.BigEndian.AppendUint32(nil, uint32(len(body)))...)
+		return append(append(frame, 0, 0), body...)
+	default:
+		n := len(body)
+		frame := append([]byte(id), byte(n>>21&0x7f), byte(n>>14&0x7f), byte(n>>7&0x7f), byte(n&0x7f), 0, 0)
+		return append(frame, body...)
+	}
+}
+
+func utf16LE(s string) []byte {
+	out := []byte{0xFF, 0xFE}
+	for _, unit := range utf16.Encode([]rune(s)) {
+		out = binary.LittleEndian.AppendUint16(out, unit)
+	}
+	return out
+}
+
+// id3v1 is the 128 byte tag at the end of a file
+func id3v1(title, artist string) []byte {
+	tag := make([]byte, 128)
+	copy(tag, "TAG")
+	copy(tag[3:33], title)
+	copy(tag[33:63], artist)
+	return tag
+}
+
+func TestReadMediaInfoID3(t *testing.T) {
+	audio := make([]byte, 2000)
+
+	tests := []struct {
+		name string
+		data []byte
+		want MediaInfo
+	}{
+		{"v2.3 latin1 and utf-16", bytes.Join([][]byte{id3Tag(3, -1,
+			id3Frame(3, "TIT2", 0, []byte("Caf\xe9")),
+			id3Frame(3, "TPE1", 1, utf16LE("Ökö"))), audio}, nil),
+			MediaInfo{Title: "Café", Performer: "Ökö"}},
+		{"v2.4 utf-8 with padding", bytes.Join([][]byte{id3Tag(4, 200,
+			id3Frame(4, "TPE1", 3, []byte("Band\x00Other")),
+			id3Frame(4, "TIT2", 3, []byte("Song ")), make([]byte, 200)), audio}, nil),
+			MediaInfo{Title: "Song", Performer: "Band"}},
+		{"v2.2", bytes.Join([][]byte{id3Tag(2, -1,
+			id3Frame(2, "TT2", 0, []byte("Old")),
+			id3Frame(2, "TP1", 0, []byte("Timer"))), audio}, nil),
+			MediaInfo{Title: "Old", Performer: "Timer"}},
+		{"v1 only", bytes.Join([][]byte{audio, id3v1("Title", "Artist")}, nil),
+			MediaInfo{Title: "Title", Performer: "Artist"}},
+		{"v2 without title falls back to v1", bytes.Join([][]byte{id3Tag(3, -1,
+			id3Frame(3, "TPE1", 0, []byte("v2 artist"))), audio, id3v1("v1 title", "v1 artist")}, nil),
+			MediaInfo{Title: "v1 title", Performer: "v1 artist"}},
+		{"no tags", audio, MediaInfo{}},
+		{"tiny file", []byte("ID"), MediaInfo{}},
+	}
+
+	for _, tt := range tests {
+		got, err := ReadMediaInfo(writeFixture(t, "song.mp3", tt.data))
+		if err != nil {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadMediaInfoID3Corrupt(t *testing.T) {
+	title := id3Frame(3, "TIT2", 0, []byte("Kept"))
+
+	tests := []struct {
+		name string
+		data []byte
+		want MediaInfo
+	}{
+		// the header claims more than the file holds, frames that are there still count
+		{"truncated tag", id3Tag(3, 5000, title), MediaInfo{Title: "Kept"}},
+		{"truncated frame", id3Tag(3, -1, title, id3Frame(3, "TPE1", 0, []byte("Cut"))[:12]),
+			MediaInfo{Title: "Kept"}},
+		{"frame size past the tag", id3Tag(3, -1, append([]byte("TIT2\x7f\xff\xff\xff\x00\x00"), "x"...)),
+			MediaInfo{}},
+		{"zero frame size", id3Tag(3, -1, []byte("TIT2\x00\x00\x00\x00\x00\x00"), title), MediaInfo{}},
+		{"corrupt v2 falls back to v1", bytes.Join([][]byte{id3Tag(4, -1, []byte("TIT2\xff\xff")), id3v1("Backup", "")}, nil),
+			MediaInfo{Title: "Backup"}},
+		{"empty text frame", id3Tag(3, -1, id3Frame(3, "TIT2", 1, nil)), MediaInfo{}},
+	}
+
+	for _, tt := range tests {
+		got, err := ReadMediaInfo(writeFixture(t, "song.mp3", tt.data))
+		if err != nil {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadMediaInfoID3SizeCap(t *testing.T) {
+	// the largest size the header can claim, about 256MB, in a tiny file
+	path := writeFixture(t, "huge.mp3", id3Tag(4, 1<<28-1, id3Frame(4, "TIT2", 3, []byte("Small"))))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	got, err := ReadMediaInfo(path)
+	runtime.ReadMemStats(&after)
+
+	if err != nil || got.Title != "Small" {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4*maxID3Size {
+		t.Errorf("allocated %s for a tiny file, the read is not capped", FormatBytes(int64(allocated)))
+	}
+}
+
+func TestReadMediaInfoImages(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadMediaInfo(writeFixture(t, "cover.PNG", buf.Bytes()))
+	if err != nil || got != (MediaInfo{Width: 3, Height: 2}) {
+		t.Errorf("png: got %+v, %v", got, err)
+	}
+
+	if _, err := ReadMediaInfo(writeFixture(t, "broken.jpg", []byte("not a jpeg"))); err == nil {
+		t.Error("broken jpeg: want an error")
+	}
+	if _, err := ReadMediaInfo(writeFixture(t, "notes.txt", []byte("text"))); err == nil {
+		t.Error("txt: want an error")
+	}
+}
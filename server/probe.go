@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// ErrNoThumbnail is returned by probers that cannot render video frames
+var ErrNoThumbnail = errors.New("thumbnails are not supported")
+
+// Time allowed for one ffprobe or ffmpeg run
+const probeTimeout = 60 * time.Second
+
+// Thumbnails are JPEGs of at most 320x320, the largest Telegram accepts
+const thumbnailSize = 320
+
+// Prober reads media details and renders video thumbnails before upload
+type Prober interface {
+	// Probe returns what could be read about the file, zero fields otherwise
+	Probe(path string) (MediaInfo, error)
+	// Thumbnail writes a JPEG preview frame of the video at path to dest
+	Thumbnail(path, dest string) error
+}
+
+// NewProber uses ffprobe and ffmpeg when both are on PATH, otherwise only
+// the container headers are read and videos are sent without a thumbnail
+func NewProber(logger *Logger) Prober {
+	ffprobe, probeErr := exec.LookPath("ffprobe")
+	ffmpeg, mpegErr := exec.LookPath("ffmpeg")
+	if probeErr != nil || mpegErr != nil {
+		logger.LogInfo("ffprobe/ffmpeg not found, reading media headers only and skipping thumbnails")
+		return HeaderProber{}
+	}
+
+	logger.LogInfo("Probing media with %s and %s", ffprobe, ffmpeg)
+	return &FFmpegProber{ffprobe: ffprobe, ffmpeg: ffmpeg}
+}
+
+// HeaderProber reads MP4, ID3 and image headers with ReadMediaInfo
+type HeaderProber struct{}
+
+func (HeaderProber) Probe(path string) (MediaInfo, error) {
+	return ReadMediaInfo(path)
+}
+
+func (HeaderProber) Thumbnail(path, dest string) error {
+	return ErrNoThumbnail
+}
+
+// FFmpegProber runs the ffprobe and ffmpeg binaries
+type FFmpegProber struct {
+	ffprobe string
+	ffmpeg  string
+}
+
+// ffprobeOutput is the part of ffprobe's JSON output the prober uses
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+	} `json:"streams"`
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+func (p *FFmpegProber) Probe(path string) (MediaInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, p.ffprobe,
+		"-v", "error",
+		"-print_format", "json",
+		"-show_entries", "format=duration:format_tags:stream=codec_type,width,height",
+		"--", path,
+	).Output()
+	if err != nil {
+		return MediaInfo{}, fmt.Errorf("ffprobe %s: %w", path, err)
+	}
+
+	var probed ffprobeOutput
+	if err := json.Unmarshal(out, &probed); err != nil {
+		return MediaInfo{}, fmt.Errorf("parse ffprobe output: %w", err)
+	}
+
+	var info MediaInfo
+	if seconds, err := strconv.ParseFloat(probed.Format.Duration, 64); err == nil {
+		info.Duration = int(seconds + 0.5)
+	}
+	for _, stream := range probed.Streams {
+		if stream.CodecType == "video" && stream.Width > 0 {
+			info.Width, info.Height = stream.Width, stream.Height
+			break
+		}
+	}
+	// tag names differ in case between containers
+	for key, value := range probed.Format.Tags {
+		switch key {
+		case "title", "TITLE", "Title":
+			info.Title = value
+		case "artist", "ARTIST", "Artist":
+			info.Performer = value
+		}
+	}
+	return info, nil
+}
+
+// Thumbnail grabs a frame a tenth into the video, skipping black intros
+func (p *FFmpegProber) Thumbnail(path, dest string) error {
+	at := 1.0
+	if info, err := p.Probe(path); err == nil && info.Duration > 10 {
+		at = float64(info.Duration) / 10
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, p.ffmpeg,
+		"-v", "error",
+		"-y",
+		"-ss", strconv.FormatFloat(at, 'f', 2, 64),
+		"-i", path,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", thumbnailSize, thumbnailSize),
+		"-q:v", "5",
+		dest,
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg thumbnail %s: %w: %s", path, err, out)
+	}
+	return nil
+}
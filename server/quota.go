@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	quotasBucket = []byte("quotas")
+	usageBucket  = []byte("usage")
+)
+
+// Quota limits what a user may download, zero fields are unlimited
+type Quota struct {
+	StorageBytes int64 `json:"storage_bytes,omitempty"` // downloaded data kept on disk
+	DailyBytes   int64 `json:"daily_bytes,omitempty"`
+	MonthlyBytes int64 `json:"monthly_bytes,omitempty"`
+	Jobs         int   `json:"jobs,omitempty"` // unfinished jobs at once
+}
+
+// Usage is what a user has downloaded. The day and month totals start
+// again with each calendar day and month
+type Usage struct {
+	StoredBytes int64  `json:"stored_bytes"`
+	Day         string `json:"day"`
+	DayBytes    int64  `json:"day_bytes"`
+	Month       string `json:"month"`
+	MonthBytes  int64  `json:"month_bytes"`
+}
+
+// roll resets the totals of periods that are over
+func (u *Usage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day = day
+		u.DayBytes = 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month = month
+		u.MonthBytes = 0
+	}
+}
+
+// UserQuota returns the quota set for userID, found is false when the default applies
+func (d *Database) UserQuota(userID int64) (quota Quota, found bool, err error) {
+	err = d.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(quotasBucket)
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get(userKey(userID))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &quota)
+	})
+	return quota, found, err
+}
+
+// SetUserQuota stores the quota of userID, nil goes back to the default
+func (d *Database) SetUserQuota(userID int64, quota *Quota) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(quotasBucket)
+		if err != nil {
+			return err
+		}
+		if quota == nil {
+			return bucket.Delete(userKey(userID))
+		}
+
+		data, err := json.Marshal(quota)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(userKey(userID), data)
+	})
+}
+
+// Usage returns what userID has downloaded so far
+func (d *Database) Usage(userID int64) (Usage, error) {
+	var usage Usage
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(usageBucket)
+		if bucket == nil {
+			return nil
+		}
+		if data := bucket.Get(userKey(userID)); data != nil {
+			return json.Unmarshal(data, &usage)
+		}
+		return nil
+	})
+	usage.roll(time.Now())
+	return usage, err
+}
+
+// AddUsage counts downloaded bytes towards the day and month totals and
+// changes the stored bytes by stored, which is negative when data is deleted
+func (d *Database) AddUsage(userID int64, downloaded, stored int64) (Usage, error) {
+	var usage Usage
+	err := d.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(usageBucket)
+		if err != nil {
+			return err
+		}
+		if data := bucket.Get(userKey(userID)); data != nil {
+			if err := json.Unmarshal(data, &usage); err != nil {
+				return err
+			}
+		}
+
+		usage.roll(time.Now())
+		usage.DayBytes += downloaded
+		usage.MonthBytes += downloaded
+		usage.StoredBytes += stored
+		if usage.StoredBytes < 0 {
+			usage.StoredBytes = 0
+		}
+
+		data, err := json.Marshal(usage)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(userKey(userID), data)
+	})
+	return usage, err
+}
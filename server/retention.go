@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var downloadsBucket = []byte("downloads")
+
+// DownloadRecord is the data a finished job left in the download directory,
+// kept until the retention policy removes it
+type DownloadRecord struct {
+	JobID       int               `json:"job_id"`
+	ChatID      int64             `json:"chat_id"`
+	UserID      int64             `json:"user_id"`
+	Name        string            `json:"name"`
+	InfoHash    string            `json:"info_hash"`
+	Paths       []string          `json:"paths"` // selected files, relative to the download directory with '/' separators
+	Size        int64             `json:"size"`
+	Charged     int64             `json:"charged"`   // bytes counted towards the user's storage quota
+	Delivered   bool              `json:"delivered"` // every file reached the chat
+	Metainfo    []byte            `json:"metainfo,omitempty"`
+	Hashes      map[string]string `json:"hashes,omitempty"` // SHA-256 of uploaded files by their path in Paths
+	Uploaded    int64             `json:"uploaded"`         // bytes seeded to peers, across restarts
+	CompletedAt time.Time         `json:"completed_at"`
+	LastAccess  time.Time         `json:"last_access"`
+}
+
+// SaveDownload inserts or replaces a download record
+func (d *Database) SaveDownload(record DownloadRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(downloadsBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(jobKey(record.JobID), data)
+	})
+}
+
+// DeleteDownload removes a download record, missing records are not an error
+func (d *Database) DeleteDownload(jobID int) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(downloadsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(jobKey(jobID))
+	})
+}
+
+// ListDownloads returns every download record ordered by job ID
+func (d *Database) ListDownloads() ([]DownloadRecord, error) {
+	var records []DownloadRecord
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(downloadsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, data []byte) error {
+			var record DownloadRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// DownloadHash returns the content hash a download record holds for the file at rel
+func (d *Database) DownloadHash(rel string) (string, bool, error) {
+	var hash string
+	var found bool
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(downloadsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, data []byte) error {
+			var record DownloadRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if h, ok := record.Hashes[rel]; ok && !found {
+				hash, found = h, true
+			}
+			return nil
+		})
+	})
+	return hash, found, err
+}
+
+// TouchDownload marks the downloads holding the file at rel as used now,
+// for the least recently used eviction of the size cap
+func (d *Database) TouchDownload(rel string) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(downloadsBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		touched := make(map[string][]byte)
+		err := bucket.ForEach(func(key, data []byte) error {
+			var record DownloadRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if !slices.Contains(record.Paths, rel) {
+				return nil
+			}
+			record.LastAccess = time.Now()
+			updated, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			touched[string(key)] = updated
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// bbolt does not allow changing a bucket while iterating it
+		for key, data := range touched {
+			if err := bucket.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveFiles deletes the files at rels below root, then the directories
+// left empty up to root. Missing files are skipped. Returns the bytes freed
+func RemoveFiles(root string, rels []string) (int64, error) {
+	root = filepath.Clean(root)
+	var freed int64
+	var errs []error
+	for _, rel := range rels {
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			errs = append(errs, fmt.Errorf("%s is outside the download directory", rel))
+			continue
+		}
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		freed += info.Size()
+
+		for dir := filepath.Dir(path); dir != root && filepath.Dir(dir) != dir; dir = filepath.Dir(dir) {
+			// fails once a directory still has entries
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return freed, errors.Join(errs...)
+}
+
+// DiskUsage returns the bytes taken by the files at path, a file or a directory tree
+func DiskUsage(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && !entry.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
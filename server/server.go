@@ -1,22 +1,159 @@
 package server
 
 import (
-	"log"
+	"context"
+	"errors"
+	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
 )
 
 // HTTP server for the app
 type Server struct {
 	router *http.ServeMux
+	links  *FileLinks
+	engine *Engine
+	db     *Database
+	logger *Logger
+	http   *http.Server
 }
 
-func NewServer() *Server {
-	return &Server{
+func NewServer(links *FileLinks, engine *Engine, db *Database, logger *Logger) *Server {
+	s := &Server{
 		router: http.NewServeMux(),
+		links:  links,
+		engine: engine,
+		db:     db,
+		logger: logger,
 	}
+	s.router.HandleFunc(linksPrefix, s.serveFile)
+	return s
 }
 
+// Start listens on addr until Shutdown is called
 func (s *Server) Start(addr string) error {
-	log.Printf("Starting server on %s", addr)
-	return http.ListenAndServe(addr, s.router)
+	s.logger.LogInfo("Starting HTTP server on %s", addr)
+	s.http = &http.Server{
+		Addr:              addr,
+		Handler:           s.router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	err := s.http.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops taking requests and waits for running downloads until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.http == nil {
+		return nil
+	}
+	return s.http.Shutdown(ctx)
+}
+
+// serveFile serves a file behind a signed link. http.ServeContent handles
+// Range requests, so players can seek and downloads can be resumed. Files
+// still downloading are read through the engine, see serveStream
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path, chatID, err := s.links.Resolve(r.URL.Path)
+	switch {
+	case errors.Is(err, ErrLinkExpired):
+		http.Error(w, "this link has expired, ask the bot for a new one", http.StatusGone)
+		return
+	case err != nil:
+		s.logger.LogError("Rejected download link from %s: %v", r.RemoteAddr, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	if reader, size, ok := s.engine.OpenStream(path); ok {
+		defer reader.Close()
+		s.serveStream(w, r, path, chatID, reader, size)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+		s.logger.LogInfo("Serving %s to %s (chat %d)", info.Name(), r.RemoteAddr, chatID)
+	}
+	if r.Method == http.MethodGet && (r.Header.Get("Range") == "" || strings.HasPrefix(r.Header.Get("Range"), "bytes=0-")) {
+		// players send many range requests, only the first read of a file counts as a use
+		if rel, err := s.links.relative(path); err == nil {
+			if err := s.db.TouchDownload(rel); err != nil {
+				s.logger.LogError("Failed to record access to %s: %v", rel, err)
+			}
+		}
+	}
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", filepath.Base(path)))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// serveStream serves a file that is not fully downloaded. Reads wait for the
+// missing pieces, which the engine fetches first, and give up when the client leaves
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request, path string, chatID int64, reader torrent.Reader, size int64) {
+	name := filepath.Base(path)
+	if r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+		s.logger.LogInfo("Streaming %s to %s (chat %d)", name, r.RemoteAddr, chatID)
+	}
+
+	// inline, so a browser plays the file instead of saving it
+	w.Header().Set("Content-Disposition", contentDisposition("inline", name))
+	http.ServeContent(w, r, name, time.Time{}, &contextReader{ctx: r.Context(), reader: reader, size: size})
+}
+
+// contextReader makes a torrent reader's blocking reads cancellable by the request
+type contextReader struct {
+	ctx    context.Context
+	reader torrent.Reader
+	size   int64
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	return c.reader.ReadContext(c.ctx, p)
+}
+
+func (c *contextReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekEnd {
+		// answered without the reader, which would start fetching the last pieces
+		return c.size + offset, nil
+	}
+	return c.reader.Seek(offset, whence)
+}
+
+// contentDisposition names the download, with a UTF-8 variant for non-ASCII names
+func contentDisposition(disposition, name string) string {
+	ascii := make([]rune, 0, len(name))
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			r = '_'
+		}
+		ascii = append(ascii, r)
+	}
+	return disposition + `; filename="` + string(ascii) + `"; filename*=UTF-8''` + url.PathEscape(name)
 }
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FilePart is one numbered part of a file too large to upload in one piece.
+// Parts are not copied anywhere, their bytes are read from the file itself
+type FilePart struct {
+	Path   string // the whole file
+	Name   string // <name>.001, <name>.002, ...
+	Offset int64
+	Size   int64
+}
+
+// SplitFile cuts the file at path into numbered parts of at most partSize bytes
+// named <name>.001, <name>.002, ... so they can be rejoined with cat or copy /b,
+// or opened directly with 7-Zip. Returns the parts in order
+func SplitFile(path string, partSize int64) ([]FilePart, error) {
+	if partSize <= 0 {
+		return nil, fmt.Errorf("invalid part size %d", partSize)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	count := int((info.Size() + partSize - 1) / partSize)
+	parts := make([]FilePart, 0, count)
+	for i := 1; i <= count; i++ {
+		offset := int64(i-1) * partSize
+		parts = append(parts, FilePart{
+			Path:   path,
+			Name:   PartName(filepath.Base(path), i),
+			Offset: offset,
+			Size:   min(partSize, info.Size()-offset),
+		})
+	}
+
+	return parts, nil
+}
+
+// PartName is the file name of part index (1-based) of name
+func PartName(name string, index int) string {
+	return fmt.Sprintf("%s.%03d", name, index)
+}
+
+// Open returns a reader of the part's bytes, closing it closes the file
+func (p FilePart) Open() (io.ReadCloser, error) {
+	file, err := os.Open(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	return partReader{io.NewSectionReader(file, p.Offset, p.Size), file}, nil
+}
+
+// partReader reads a section of a file it owns
+type partReader struct {
+	*io.SectionReader
+	io.Closer
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/anacrolix/torrent"
+)
+
+// streamReadahead is how far ahead of a stream reader pieces are requested,
+// enough for a player to keep going while the next pieces arrive
+const streamReadahead = 32 << 20
+
+// Stream switches a file to sequential download: it is selected with a high
+// priority and read from the start in the background, so its pieces arrive
+// in order and a player can start before the file is complete. Only one file
+// of a job streams at a time. Returns the path the file is written to
+func (d *Downloader) Stream(fileID int) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.torrent == nil || d.torrent.Info() == nil {
+		return "", errors.New("no active torrent")
+	}
+	if fileID < 0 || fileID >= len(d.files) {
+		return "", fmt.Errorf("invalid file id: %d", fileID)
+	}
+
+	d.files[fileID].Priority = PriorityHigh
+	d.files[fileID].Selected = true
+	if d.started {
+		d.applyPriorities()
+	}
+
+	if d.stopStream != nil {
+		d.stopStream()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.stopStream = cancel
+
+	file := d.torrent.Files()[fileID]
+	go d.readSequentially(ctx, file)
+
+	d.logger.LogInfo("Streaming %s sequentially", file.DisplayPath())
+	return d.engine.filePath(file), nil
+}
+
+// readSequentially reads file from start to end and throws the data away.
+// The reader's readahead window makes the engine fetch pieces in file order
+func (d *Downloader) readSequentially(ctx context.Context, file *torrent.File) {
+	reader := file.NewReader()
+	defer reader.Close()
+	reader.SetReadahead(streamReadahead)
+
+	buf := make([]byte, 1<<20)
+	for {
+		_, err := reader.ReadContext(ctx, buf)
+		if errors.Is(err, io.EOF) {
+			d.logger.LogInfo("Sequential download of %s finished", file.DisplayPath())
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// OpenStream opens a reader on the file at path when it belongs to a torrent
+// the engine holds and is not complete yet. Reads block until the pieces they
+// need are downloaded, and the pieces under the read position are fetched first
+func (e *Engine) OpenStream(path string) (torrent.Reader, int64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, shared := range e.torrents {
+		if shared.torrent.Info() == nil {
+			continue
+		}
+		for _, file := range shared.torrent.Files() {
+			if e.filePath(file) != path {
+				continue
+			}
+			if file.BytesCompleted() == file.Length() {
+				return nil, 0, false
+			}
+
+			reader := file.NewReader()
+			reader.SetResponsive()
+			reader.SetReadahead(streamReadahead)
+			return reader, file.Length(), true
+		}
+	}
+	return nil, 0, false
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var usersBucket = []byte("users")
+
+// UserRecord is a user or chat added to the allowlist at runtime
+type UserRecord struct {
+	ID      int64     `json:"id"`
+	Role    string    `json:"role"`
+	AddedBy int64     `json:"added_by"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// SaveUser inserts or replaces an allowlist entry
+func (d *Database) SaveUser(record UserRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(usersBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(userKey(record.ID), data)
+	})
+}
+
+// DeleteUser removes an allowlist entry, missing entries are not an error
+func (d *Database) DeleteUser(id int64) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(userKey(id))
+	})
+}
+
+// ListUsers returns every stored allowlist entry
+func (d *Database) ListUsers() ([]UserRecord, error) {
+	var records []UserRecord
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, data []byte) error {
+			var record UserRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// chat IDs of groups are negative, so keys are the decimal ID
+func userKey(id int64) []byte {
+	return []byte(strconv.FormatInt(id, 10))
+}